@@ -0,0 +1,365 @@
+package channel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/svent/cliptun/transport"
+	"golang.org/x/crypto/hkdf"
+)
+
+// In broadcast mode, data is only sent in one direction, for links where
+// the clipboard is synchronized towards one side only. The client sends,
+// the server receives and never writes to the transport. As there is no
+// handshake, the packets are sealed using a key derived from the password
+// (so there is no forward secrecy), and the sender picks a random session
+// ID, which the receiver adopts from the first packet read.
+//
+// The sender writes the packets in groups of up to broadcastGroup packets,
+// each followed by its parity packets (see fec.go). A group ends early if
+// no more data is queued, so data sent slowly is not held back. The sender
+// only keeps the groups not sent the configured number of times yet: every
+// round, it takes the next group, and writes all groups kept once more
+// (the oldest first, a single packet per interval on the clipboard, as many
+// as the send window allows on stream transports), so the repetitions of a
+// group are spread over several rounds and the memory used is bounded.
+// Once the channel is closed, the sender adds an END control packet
+// containing the length and the SHA-256 hash of all data, and stops once
+// all groups have been sent often enough. The receiver fills in the packets
+// it missed from the repetitions, delivers the data in order, and closes
+// the channel once the END packet arrived, with an error if the data does
+// not match it. The peer timeout only applies to the receiver, as the
+// sender never hears from it, so the sender writes keepalive packets while
+// there is no data to send.
+
+const (
+	broadcastGroup = 16
+	// used unless another redundancy ratio is configured
+	defaultBroadcastFEC    = 0.25
+	defaultBroadcastRepeat = 3
+	// the number of handshake packets left unanswered before a one-way
+	// link is suspected
+	oneWayAttempts = 5
+)
+
+type broadcastState struct {
+	enabled bool
+	repeat  int
+
+	// sender: the groups not sent often enough yet (oldest first), the
+	// packets left to write in the current round, the sequence number of
+	// the next packet, and whether the data has ended
+	groups []broadcastGroupState
+	round  []CBPacket
+	seq    int
+	ended  bool
+
+	// receiver: the content read last (the clipboard keeps it until the
+	// next packet is written), and the last packet delivered
+	lastRead  string
+	started   bool
+	recvIndex int
+
+	// length and hash of the data sent or delivered so far
+	length int64
+	hash   hash.Hash
+}
+
+// broadcastGroupState is a group of packets followed by its parity
+// packets, and the number of times it has been sent.
+type broadcastGroupState struct {
+	packets []CBPacket
+	passes  int
+}
+
+// startBroadcast sets up the keys and the session for broadcast mode.
+func (c *Channel) startBroadcast(repeat int) error {
+	b := &c.broadcast
+	b.enabled = true
+	b.repeat = repeat
+	if b.repeat <= 0 {
+		b.repeat = defaultBroadcastRepeat
+	}
+	b.recvIndex = -1
+	b.hash = sha256.New()
+	if c.fec.ratio == 0 {
+		c.fec.ratio = defaultBroadcastFEC
+	}
+
+	kdf := hkdf.New(sha256.New, c.masterKey[:], nil, []byte("cliptun broadcast"))
+	if _, err := io.ReadFull(kdf, c.sendKey[:]); err != nil {
+		return fmt.Errorf("cannot derive broadcast key: %s", err)
+	}
+	c.recvKey = c.sendKey
+	c.nextRecvKey = c.sendKey
+	c.handshake.established = true
+	c.handshake.confirmed = true
+	c.codec = codecByName(c.compression)
+	if c.configuredEncoding != "" {
+		c.encoding = encodingByName(c.configuredEncoding)
+	}
+
+	if c.ownHeader == CLIENT {
+		var id [8]byte
+		if _, err := io.ReadFull(rand.Reader, id[:]); err != nil {
+			return fmt.Errorf("cannot get random bytes for session: %s", err)
+		}
+		c.session = binary.BigEndian.Uint64(id[:])
+		c.debugLogger.Printf("sending broadcast %016x (each packet %d times)\n", c.session, b.repeat)
+		c.statsConnected()
+		close(c.connected)
+	} else {
+		c.debugLogger.Println("waiting for broadcast")
+	}
+	return nil
+}
+
+// broadcastReceiver returns whether the channel receives a broadcast,
+// which means it must not write to the transport.
+func (c *Channel) broadcastReceiver() bool {
+	return c.broadcast.enabled && c.ownHeader == SERVER
+}
+
+func (c *Channel) handleBroadcastLoop() {
+	for {
+		interval := c.Interval()
+		if c.broadcastReceiver() {
+			// read twice per interval to catch every packet written
+			interval /= 2
+		}
+		select {
+		case <-c.stopping:
+			c.shutdown()
+			return
+		case <-time.After(interval):
+		}
+		if c.broadcastReceiver() {
+			c.receiveBroadcast()
+			c.checkPeerTimeout()
+		} else {
+			c.sendBroadcast()
+		}
+	}
+}
+
+// sendBroadcast writes the next packets.
+func (c *Channel) sendBroadcast() {
+	b := &c.broadcast
+	for i := 0; i < c.window; i++ {
+		if len(b.round) == 0 && !c.nextBroadcastRound() {
+			if b.ended {
+				c.debugLogger.Println("broadcast sent completely")
+				c.stop(nil)
+			} else {
+				c.broadcastKeepalive()
+			}
+			return
+		}
+		c.writePacket(b.round[0])
+		b.round = b.round[1:]
+	}
+}
+
+// nextBroadcastRound adds the next group to the groups kept, and queues
+// all of them to be written once more. It returns false if there is
+// nothing left to write.
+func (c *Channel) nextBroadcastRound() bool {
+	b := &c.broadcast
+	if b.ended {
+		// the END packet has been written, the receiver stops once it
+		// received all data, so the transport may be closed from now on
+		c.peerClosed = true
+	}
+	if group := c.nextBroadcastGroup(); len(group) > 0 {
+		b.groups = append(b.groups, broadcastGroupState{packets: group})
+	}
+	kept := b.groups[:0]
+	for _, g := range b.groups {
+		b.round = append(b.round, g.packets...)
+		g.passes++
+		if g.passes < b.repeat {
+			kept = append(kept, g)
+		}
+	}
+	b.groups = kept
+	return len(b.round) > 0
+}
+
+// nextBroadcastGroup returns the next group of packets passed to Send,
+// followed by its parity packets, or nil if there are none.
+func (c *Channel) nextBroadcastGroup() []CBPacket {
+	b := &c.broadcast
+	var group []CBPacket
+	for len(group) < broadcastGroup && !b.ended {
+		p, ok := c.nextPacket(false)
+		if !ok {
+			break
+		}
+		if p.Type == PacketTypeControl {
+			if p.Payload != "FIN" {
+				continue
+			}
+			// the channel has been closed, the data ends here
+			p.Payload = fmt.Sprintf("END:%d:%x", b.length, b.hash.Sum(nil))
+			b.ended = true
+			c.debugLogger.Printf("broadcast data complete (%s)\n", humanize.IBytes(uint64(b.length)))
+		} else {
+			b.length += int64(len(p.Payload))
+			b.hash.Write([]byte(p.Payload))
+			c.updateStats(func(s *Stats) { s.DataSent += int64(len(p.Payload)) })
+		}
+		p.Session = c.session
+		p.Seq = b.seq
+		p.Ack = -1
+		b.seq++
+		group = append(group, p)
+	}
+	if len(group) == 0 {
+		return nil
+	}
+	return append(group, c.parityPackets(group)...)
+}
+
+// broadcastKeepalive writes a KEEPALIVE control packet if nothing has been
+// sent for a while, so the receiver does not time out while no data is
+// passed to Send. It is not part of the sequence of packets, so the
+// receiver only takes it as a sign of life.
+func (c *Channel) broadcastKeepalive() {
+	if c.keepaliveInterval <= 0 || time.Now().Sub(c.keepalive.lastSent) < c.keepaliveInterval {
+		return
+	}
+	c.writePacket(CBPacket{Target: c.peerHeader, Session: c.session, Type: PacketTypeControl,
+		Seq: -1, Ack: -1, Payload: "KEEPALIVE"})
+}
+
+// receiveBroadcast reads the packets written by the sender and delivers
+// the data in order.
+func (c *Channel) receiveBroadcast() {
+	b := &c.broadcast
+	content, _ := c.transport.Read()
+	_, clipboard := c.transport.(*transport.Clipboard)
+	if content == b.lastRead || clipboard && !b.started {
+		// the clipboard still holds the packet read last (or the content
+		// left over from before)
+		b.lastRead, b.started = content, true
+		return
+	}
+	b.lastRead = content
+	for _, data := range extractPackets(content) {
+		if data == "" {
+			continue
+		}
+		packet, err := c.string2packet(data)
+		if err == errForeignPacket {
+			continue
+		}
+		if verr, ok := err.(*versionError); ok {
+			c.reportVersionMismatch(verr)
+			continue
+		}
+		if err != nil {
+			c.debugLogger.Println("cannot read packet from clipboard:", err)
+			continue
+		}
+		if packet.Target != c.ownHeader || packet.Type == PacketTypeHandshake || packet.Type == PacketTypeProbe {
+			continue
+		}
+		if c.session == 0 {
+			c.session = packet.Session
+			c.debugLogger.Printf("receiving broadcast %016x\n", c.session)
+			c.statsConnected()
+			close(c.connected)
+		}
+		if packet.Session != c.session {
+			continue
+		}
+		c.peerAlive()
+		c.updateStats(func(s *Stats) {
+			s.PacketsReceived++
+			s.BytesReceived += int64(len(data))
+		})
+		if packet.Type == PacketTypeParity {
+			c.processParityPacket(packet, b.recvIndex)
+		} else if packet.Seq > b.recvIndex {
+			c.receiveQueue[packet.Seq] = packet
+			c.fecReceived(packet)
+		}
+		c.recoverPackets(b.recvIndex)
+		if !c.deliverBroadcast() {
+			return
+		}
+	}
+}
+
+// deliverBroadcast delivers all packets that are now in order, and
+// returns false once the broadcast has ended.
+func (c *Channel) deliverBroadcast() bool {
+	b := &c.broadcast
+	for {
+		packet, ok := c.receiveQueue[b.recvIndex+1]
+		if !ok {
+			return true
+		}
+		b.recvIndex++
+		delete(c.receiveQueue, b.recvIndex)
+		if packet.Type == PacketTypeControl {
+			c.finishBroadcast(packet.Payload)
+			return false
+		}
+		b.length += int64(len(packet.Payload))
+		b.hash.Write([]byte(packet.Payload))
+		c.updateStats(func(s *Stats) { s.DataReceived += int64(len(packet.Payload)) })
+		if packet.More {
+			c.fragments = append(c.fragments, packet.Payload...)
+			continue
+		}
+		if len(c.fragments) > 0 {
+			packet.Payload = string(append(c.fragments, packet.Payload...))
+			c.fragments = nil
+		}
+		if packet.Payload == "" {
+			continue
+		}
+		select {
+		case c.receiveChan <- packet:
+		case <-c.stopping:
+			return false
+		}
+	}
+}
+
+// finishBroadcast checks the data received against the END packet and
+// closes the channel.
+func (c *Channel) finishBroadcast(payload string) {
+	b := &c.broadcast
+	args := strings.Split(payload, ":")
+	if len(args) != 3 || args[0] != "END" {
+		c.stop(fmt.Errorf("received malformed end of broadcast"))
+		return
+	}
+	length, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || length != b.length || args[2] != fmt.Sprintf("%x", b.hash.Sum(nil)) {
+		c.stop(fmt.Errorf("broadcast integrity check failed: the data received does not match the data sent"))
+		return
+	}
+	c.debugLogger.Printf("broadcast received completely (%s)\n", humanize.IBytes(uint64(length)))
+	c.stop(nil)
+}
+
+// suggestBroadcast tells the operator about broadcast mode once the
+// handshake failed often enough to suspect a one-way link.
+func (c *Channel) suggestBroadcast(reason string) {
+	hs := &c.handshake
+	hs.unanswered++
+	if hs.unanswered == oneWayAttempts {
+		c.errorLogger.Printf("%s, if the link only works in one direction, try broadcast mode (--broadcast with stdin and stdout)\n", reason)
+	}
+}
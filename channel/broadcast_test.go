@@ -0,0 +1,113 @@
+package channel
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/svent/cliptun/transport"
+)
+
+// broadcastSender returns a channel sending a broadcast to clip.
+func broadcastSender(clip *memClipboard) *Channel {
+	c := testChannel(CLIENT, "")
+	c.transport = clip
+	c.window = 1
+	c.fec.ratio = defaultBroadcastFEC
+	c.broadcast = broadcastState{enabled: true, repeat: defaultBroadcastRepeat, hash: sha256.New()}
+	c.sendChan = make(chan CBPacket, 100)
+	c.aborted = make(chan struct{})
+	c.stopping = make(chan struct{})
+	c.debugLogger = newLevelLogger(nil, LevelDebug)
+	return c
+}
+
+func TestBroadcastRepeat(t *testing.T) {
+	clip := &memClipboard{}
+	c := broadcastSender(clip)
+	const packets = 5*broadcastGroup + 3
+	var data string
+	for i := 0; i < packets; i++ {
+		p := CBPacket{Target: c.peerHeader, Payload: fmt.Sprint(i)}
+		data += p.Payload
+		c.sendChan <- p
+	}
+	c.sendChan <- CBPacket{Target: c.peerHeader, Type: PacketTypeControl, Payload: "FIN"}
+
+	for n := 0; ; n++ {
+		select {
+		case <-c.stopping:
+		default:
+			if n == 10000 {
+				t.Fatal("broadcast not finished")
+			}
+			c.sendBroadcast()
+			if len(c.broadcast.groups) >= c.broadcast.repeat {
+				t.Fatalf("%d groups kept", len(c.broadcast.groups))
+			}
+			continue
+		}
+		break
+	}
+	if c.err != nil {
+		t.Fatal(c.err)
+	}
+
+	receiver := testChannel(SERVER, "")
+	sent := make(map[int]int)
+	parity := 0
+	for _, text := range clip.writes {
+		p, err := receiver.string2packet(extractPackets(text)[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Type == PacketTypeParity {
+			parity++
+			continue
+		}
+		sent[p.Seq]++
+		if p.Seq == packets {
+			want := fmt.Sprintf("END:%d:%x", len(data), sha256.Sum256([]byte(data)))
+			if p.Type != PacketTypeControl || p.Payload != want {
+				t.Errorf("got end packet %+v, want %q", p, want)
+			}
+		} else if p.Payload != fmt.Sprint(p.Seq) {
+			t.Errorf("packet %d: got payload %q", p.Seq, p.Payload)
+		}
+	}
+	for seq := 0; seq <= packets; seq++ {
+		if sent[seq] != c.broadcast.repeat {
+			t.Errorf("packet %d sent %d times, want %d", seq, sent[seq], c.broadcast.repeat)
+		}
+	}
+	if len(sent) != packets+1 || parity == 0 {
+		t.Errorf("got %d packets and %d parity packets", len(sent), parity)
+	}
+}
+
+func TestBroadcastSlowData(t *testing.T) {
+	clip := &memClipboard{}
+	c := broadcastSender(clip)
+	c.sendChan <- CBPacket{Target: c.peerHeader, Payload: "slow"}
+	// the group ends once no more data is queued, and is repeated without
+	// waiting for more
+	for i := 0; i < 10; i++ {
+		c.sendBroadcast()
+	}
+	n := 0
+	for _, text := range clip.writes {
+		if strings.Contains(text, transport.PacketBegin) {
+			n++
+		}
+	}
+	// the packet and its parity packet
+	if want := 2 * c.broadcast.repeat; n != want {
+		t.Errorf("got %d packets written, want %d", n, want)
+	}
+	select {
+	case <-c.stopping:
+		t.Error("broadcast stopped before the channel was closed")
+	default:
+	}
+}
@@ -2,19 +2,15 @@ package channel
 
 import (
 	"bytes"
-	"compress/zlib"
+	"context"
 	"crypto/rand"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	mrand "math/rand"
-	"net"
-	"os"
-	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,11 +18,12 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/svent/cliptun/transport"
 	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	QueueSize = 16
+	// BlocksizeLimit is the largest blocksize supported
+	BlocksizeLimit = 16 * 1024 * 1024
 )
 
 type CBPacketType int
@@ -34,14 +31,40 @@ type CBPacketType int
 const (
 	PacketTypeData CBPacketType = iota
 	PacketTypeControl
+	PacketTypeHandshake
+	PacketTypeProbe
+	PacketTypeParity
 )
 
 type CBPacket struct {
 	Target  PeerType
+	Session uint64
 	Type    CBPacketType
 	Payload string
 	Seq     int
-	Ack     int
+	// Ack is the highest sequence number up to which all packets were
+	// received, SAck lists packets received out of order beyond Ack.
+	Ack  int
+	SAck []int
+	// Streamed is set if the payload is compressed by the session's
+	// compression stream
+	Streamed bool
+	// More is set for all but the last fragment of data passed to Send
+	More bool
+	// cancel is closed if the data must not be sent anymore, bulk is set
+	// for bulk data (both not sent to the peer)
+	cancel <-chan struct{}
+	bulk   bool
+}
+
+// cancelled returns whether the packet must not be sent anymore.
+func (p CBPacket) cancelled() bool {
+	select {
+	case <-p.cancel:
+		return true
+	default:
+		return false
+	}
 }
 
 type channelOpenDirectMsg struct {
@@ -58,18 +81,24 @@ const (
 	SERVER
 )
 
-var (
-	netTimeout  = 50 * time.Millisecond
-	errorLogger = log.New(ioutil.Discard, "", 0)
-	debugLogger = log.New(ioutil.Discard, "", 0)
-	traceLogger = log.New(ioutil.Discard, "", 0)
-)
+// ErrClosed is returned by Send once the channel has been closed.
+var ErrClosed = errors.New("channel closed")
 
 type Channel struct {
 	interval   time.Duration
 	bufferSize int
+	window     int
+	autoTune   bool
+	tuner      linkTuner
+	tuneMutex  sync.Mutex
 
 	transport transport.Transport
+	// the content last written to the transport, see appendText
+	lastText string
+	// the address of the pair (nil if unnamed), and the state of a
+	// transport shared with other pairs, see medium.go
+	address []byte
+	medium  mediumState
 
 	receiveQueue      map[int]CBPacket
 	receiveChan       chan CBPacket
@@ -78,41 +107,165 @@ type Channel struct {
 	sendQueue      map[int]CBPacket
 	sendChan       chan CBPacket
 	sendQueueIndex int
+	// control packets bypass the data queued in sendChan, bulk data only
+	// takes up as many entries as bulkSlots holds, see queue.go
+	controlChan chan CBPacket
+	bulkSlots   chan struct{}
+	// aborted is closed once the data not sent yet is dropped
+	aborted   chan struct{}
+	abortOnce sync.Once
 
-	ownHeader       PeerType
-	peerHeader      PeerType
-	secretKey       [32]byte
-	delayedShutdown sync.Once
+	ownHeader  PeerType
+	peerHeader PeerType
+	// masterKey is derived from the password and only used for the
+	// handshake, the other keys are the keys of the current session
+	masterKey [32]byte
+	kdf       string
+	// the configured compression codec, and the codec used for sending
+	// (which falls back to the default if the peer does not support it)
+	compression    string
+	codec          *codec
+	incompressible int
+	// the configured text encoding (empty to use the client's choice), and
+	// the encoding agreed on for the session
+	configuredEncoding string
+	encoding           *textEncoding
+	wrap               int
+	probeEnabled       bool
+	probe              probeState
+	fec                fecState
+	broadcast          broadcastState
+	stats              statsState
+	keepalive          keepaliveState
+	keepaliveInterval  time.Duration
+	peerTimeout        time.Duration
+	peerStateCallback  PeerStateCallback
+	// the session is saved to sessionFile to resume it after a restart,
+	// keepSession is set once the channel has been suspended
+	sessionFile    string
+	keepSession    bool
+	resume         resumeState
+	resumeCallback ResumeCallback
+	// compression streams, only used if enabled
+	streamCompression bool
+	sendStream        *streamCompressor
+	recvStream        *streamDecompressor
+	sendKey           [32]byte
+	recvKey           [32]byte
+	nextRecvKey       [32]byte
+	rekey             rekeyState
+	rekeyPackets      int64
+	rekeyBytes        int64
+	rekeyInterval     time.Duration
+	session           uint64
+	handshake         handshakeState
+	pairing           bool
+	pairingCallback   PairingCallback
+	connected         chan struct{}
+	delayedShutdown   sync.Once
+	// stopping is closed to stop handleClipboardLoop, done once it has
+	// stopped, err is the reason (nil if closed regularly)
+	stopping  chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	err       error
+	// peerClosed is set once the peer sent a FIN (or may have stopped
+	// receiving at any time, see sendBroadcast)
+	peerClosed bool
+	// incompatible versions already reported, and when the first version
+	// NAK was received
+	reportedVersion map[versionError]bool
+	firstVersionNak time.Time
+
+	// sendMutex serializes calls to Send, fragments holds the data of
+	// fragments received until the last one arrives
+	sendMutex sync.Mutex
+	fragments []byte
+
+	// readBuffer holds data received but not returned by Read yet
+	readMutex     sync.Mutex
+	readBuffer    []byte
+	readDeadline  deadline
+	writeDeadline deadline
 
 	controlPacketCallback ControlPacketCallback
+
+	errorLogger *log.Logger
+	debugLogger *log.Logger
+	traceLogger *log.Logger
 }
 
 type ControlPacketCallback func(cmd, arg string)
 
+// PairingCallback shows the pairing code to the operator and returns
+// whether it matches the code displayed on the peer's side.
+type PairingCallback func(code string) bool
+
 type ChannelOptions struct {
 	ControlPacketCallback ControlPacketCallback
 	Interval              time.Duration
 	Password              string
+	KDF                   string
+	Compression           string
+	StreamCompression     bool
+	Encoding              string
+	Wrap                  int
+	FECRatio              float64
+	ProbeBlocksize        bool
+	KeepaliveInterval     time.Duration
+	PeerTimeout           time.Duration
+	PeerStateCallback     PeerStateCallback
+	SessionFile           string
+	ResumeCallback        ResumeCallback
+	Key                   []byte
+	Pairing               bool
+	PairingCallback       PairingCallback
 	Transport             string
 	Blocksize             int
-	ErrorLogger           *log.Logger
-	DebugLogger           *log.Logger
-	TraceLogger           *log.Logger
+	Window                int
+	AutoTune              bool
+	MinInterval           time.Duration
+	MaxInterval           time.Duration
+	MinBlocksize          int
+	MaxBlocksize          int
+	RekeyPackets          int64
+	RekeyBytes            int64
+	RekeyInterval         time.Duration
+	// Logger receives the messages of the channel, nothing is logged if
+	// it is nil
+	Logger Logger
+	// Network is the network used by a tunnel for port forwardings and
+	// the SOCKS server ("tcp4" if empty)
+	Network string
+	// Broadcast sends data in one direction only (from the client to the
+	// server), without a handshake, for links that do not work the other
+	// way. All packets are sent BroadcastRepeat times (3 if 0).
+	Broadcast       bool
+	BroadcastRepeat int
+	// Name is the name of the server, which allows several pairs to share
+	// a transport. The server uses it as its own name, the client to
+	// select the server to connect to.
+	Name string
 }
 
 func NewChannel(typ PeerType, options ChannelOptions) (*Channel, error) {
-	if options.ErrorLogger != nil {
-		errorLogger = options.ErrorLogger
-	}
-	if options.DebugLogger != nil {
-		debugLogger = options.DebugLogger
-	}
-	if options.TraceLogger != nil {
-		traceLogger = options.TraceLogger
-	}
+	return NewChannelContext(context.Background(), typ, options)
+}
 
+// NewChannelContext creates a channel that is aborted (see Abort) once the
+// context is done.
+func NewChannelContext(ctx context.Context, typ PeerType, options ChannelOptions) (*Channel, error) {
 	c := Channel{}
+	c.errorLogger = newLevelLogger(options.Logger, LevelError)
+	c.debugLogger = newLevelLogger(options.Logger, LevelDebug)
+	c.traceLogger = newLevelLogger(options.Logger, LevelTrace)
 	c.controlPacketCallback = options.ControlPacketCallback
+	c.connected = make(chan struct{})
+	c.stopping = make(chan struct{})
+	c.done = make(chan struct{})
+	c.readDeadline = newDeadline()
+	c.writeDeadline = newDeadline()
 
 	c.receiveQueue = make(map[int]CBPacket)
 	c.receiveChan = make(chan CBPacket)
@@ -121,6 +274,8 @@ func NewChannel(typ PeerType, options ChannelOptions) (*Channel, error) {
 	c.sendQueue = make(map[int]CBPacket)
 	c.sendChan = make(chan CBPacket, QueueSize)
 	c.sendQueueIndex = -1
+	c.controlChan = make(chan CBPacket, QueueSize)
+	c.aborted = make(chan struct{})
 
 	if options.Interval > 0 {
 		c.interval = options.Interval
@@ -128,24 +283,97 @@ func NewChannel(typ PeerType, options ChannelOptions) (*Channel, error) {
 
 	c.bufferSize = options.Blocksize
 
-	debugLogger.Println("using transport:", options.Transport)
+	// the transports are set up for the smallest interval and the largest
+	// blocksize the link may be tuned to
+	transportInterval, transportBufferSize := c.interval, c.bufferSize
+	if options.AutoTune {
+		c.autoTune = true
+		c.tuner = linkTuner{
+			minInterval:  options.MinInterval,
+			maxInterval:  options.MaxInterval,
+			minBlocksize: options.MinBlocksize,
+			maxBlocksize: options.MaxBlocksize,
+		}
+		if c.tuner.minInterval <= 0 {
+			c.tuner.minInterval = c.interval / 4
+		}
+		if c.tuner.maxInterval <= 0 {
+			c.tuner.maxInterval = c.interval * 4
+		}
+		if c.tuner.minBlocksize <= 0 {
+			c.tuner.minBlocksize = c.bufferSize / 16
+		}
+		if c.tuner.maxBlocksize <= 0 {
+			c.tuner.maxBlocksize = c.bufferSize
+		}
+		if c.tuner.minInterval > c.tuner.maxInterval || c.tuner.minBlocksize > c.tuner.maxBlocksize {
+			return nil, fmt.Errorf("invalid bounds for auto-tuning")
+		}
+		if c.interval < c.tuner.minInterval || c.interval > c.tuner.maxInterval {
+			c.interval = c.tuner.maxInterval
+		}
+		if c.bufferSize < c.tuner.minBlocksize || c.bufferSize > c.tuner.maxBlocksize {
+			c.bufferSize = c.tuner.minBlocksize
+		}
+		transportInterval, transportBufferSize = c.tuner.minInterval, c.tuner.maxBlocksize
+		c.debugLogger.Printf("auto-tuning interval (%s - %s) and blocksize (%s - %s)\n",
+			c.tuner.minInterval, c.tuner.maxInterval,
+			humanize.IBytes(uint64(c.tuner.minBlocksize)), humanize.IBytes(uint64(c.tuner.maxBlocksize)))
+	}
+
+	if options.ProbeBlocksize {
+		c.probeEnabled = true
+		c.probe.min, c.probe.max = options.MinBlocksize, options.MaxBlocksize
+		if c.autoTune {
+			c.probe.min, c.probe.max = c.tuner.minBlocksize, c.tuner.maxBlocksize
+		}
+		if c.probe.min <= 0 {
+			c.probe.min = c.bufferSize / 16
+		}
+		if c.probe.max <= 0 {
+			c.probe.max = c.bufferSize
+		}
+		if c.probe.min > c.probe.max {
+			return nil, fmt.Errorf("invalid bounds for probing the blocksize")
+		}
+		// send small packets until probing is finished
+		c.bufferSize = c.probe.min
+		transportBufferSize = c.probe.max
+	}
+	if transportBufferSize > BlocksizeLimit {
+		return nil, fmt.Errorf("blocksize must not exceed %s", humanize.IBytes(BlocksizeLimit))
+	}
+
+	c.peerTimeout = options.PeerTimeout
+	c.keepaliveInterval = options.KeepaliveInterval
+	if c.keepaliveInterval <= 0 {
+		c.keepaliveInterval = c.peerTimeout / 3
+	}
+	c.peerStateCallback = options.PeerStateCallback
+
+	c.window = 1
+	if options.Window > 1 {
+		c.window = options.Window
+	}
+
+	c.debugLogger.Println("using transport:", options.Transport)
 	if options.Transport == "" || options.Transport == "clipboard" {
 		c.transport = &transport.Clipboard{}
 	} else {
 		if strings.HasPrefix(options.Transport, "exec=") {
 			var err error
-			c.transport, err = transport.NewCommand(options.Transport[5:], c.bufferSize*2, c.interval)
+			c.transport, err = transport.NewCommand(options.Transport[5:], transportBufferSize*2, transportInterval)
 			if err != nil {
 				return nil, fmt.Errorf("cannot create transport: %s", err)
 			}
 		} else if strings.HasPrefix(options.Transport, "tcp=") {
-			t, err := transport.DialTCP(options.Transport[4:], c.bufferSize*2, c.interval)
+			t, err := transport.DialTCP(options.Transport[4:], transportBufferSize*2, transportInterval)
 			if err != nil {
 				return nil, fmt.Errorf("cannot dial tcp connection: %s", err)
 			}
 			c.transport = t
 		} else if strings.HasPrefix(options.Transport, "tcp-listen=") {
-			t, err := transport.ListenTCP(options.Transport[11:], c.bufferSize*2, c.interval)
+			t, err := transport.ListenTCP(options.Transport[11:], transportBufferSize*2, transportInterval)
 			if err != nil {
 				return nil, fmt.Errorf("cannot dial tcp connection: %s", err)
 			}
@@ -154,16 +382,96 @@ func NewChannel(typ PeerType, options ChannelOptions) (*Channel, error) {
 			return nil, fmt.Errorf("unknown transport method")
 		}
 	}
+	if _, ok := c.transport.(*transport.Clipboard); ok && c.window > 1 {
+		// the clipboard only holds the last packet written
+		c.debugLogger.Println("clipboard transport does not support a send window, using window size 1")
+		c.window = 1
+	}
+	slots := bulkQueueSize
+	if c.window > slots {
+		slots = c.window
+	}
+	if slots > QueueSize {
+		slots = QueueSize
+	}
+	c.bulkSlots = make(chan struct{}, slots)
+
+	if options.Pairing {
+		if options.PairingCallback == nil {
+			return nil, fmt.Errorf("pairing mode requires a callback to confirm the pairing code")
+		}
+		c.pairing = true
+		c.pairingCallback = options.PairingCallback
+	}
 
-	if options.Password == "" {
-		errorLogger.Fatalln("no password for encryption given")
+	if options.Compression == "" {
+		options.Compression = defaultCodec
+	}
+	if codecByName(options.Compression) == nil {
+		return nil, fmt.Errorf("unknown compression codec '%s' (supported: %s)", options.Compression, strings.Join(CodecNames(), ", "))
+	}
+	c.compression = options.Compression
+	c.streamCompression = options.StreamCompression
+	if options.Encoding != "" && encodingByName(options.Encoding) == nil {
+		return nil, fmt.Errorf("unknown encoding '%s' (supported: %s)", options.Encoding, strings.Join(EncodingNames(), ", "))
+	}
+	c.configuredEncoding = options.Encoding
+	if options.Name != "" {
+		c.address = pairAddress(options.Name)
+		c.debugLogger.Printf("using pair name %q\n", options.Name)
+	}
+	c.wrap = options.Wrap
+	if options.FECRatio < 0 || options.FECRatio > fecMaxRatio {
+		return nil, fmt.Errorf("invalid ratio for forward error correction: %g (must be between 0 and %d)", options.FECRatio, fecMaxRatio)
+	}
+	c.fec.ratio = options.FECRatio
+	c.fec.size = fecGroupSize(c.fec.ratio)
+	if _, ok := c.transport.(*transport.Clipboard); ok && c.fec.ratio > 0 && !options.Broadcast {
+		// the groups span several rounds, the next packet is written once
+		// the acknowledgement is overdue (see fec.go)
+		c.fec.clipboard = true
+		c.window = c.fec.size
+		c.debugLogger.Printf("using groups of %d packets for forward error correction\n", c.fec.size)
+	}
+	c.encoding = encodingByName(defaultEncoding)
+	c.codec = codecByName(defaultCodec)
+
+	c.rekeyPackets = options.RekeyPackets
+	c.rekeyBytes = options.RekeyBytes
+	c.rekeyInterval = options.RekeyInterval
+
+	if options.SessionFile != "" && c.streamCompression {
+		return nil, fmt.Errorf("sessions cannot be resumed using stream compression")
+	}
+	c.sessionFile = options.SessionFile
+	c.resumeCallback = options.ResumeCallback
+	c.resume.saved = [3]int{-1, -1, -1}
+
+	var key []byte
+	if options.Key != nil {
+		key = options.Key
+		c.kdf = "key"
+	} else {
+		if options.Password == "" {
+			return nil, fmt.Errorf("no password for encryption given")
+		}
+		if options.KDF == "" {
+			options.KDF = "pbkdf2"
+		}
+		kdf, err := ParseKDF(options.KDF)
+		if err != nil {
+			return nil, err
+		}
+		c.debugLogger.Println("deriving key using", kdf)
+		key, err = kdf.DeriveKey(options.Password)
+		if err != nil {
+			return nil, fmt.Errorf("could not derive key from password: %s", err)
+		}
+		c.kdf = kdf.String()
 	}
-	// use a static salt as we need the same hash on both sides of the tunnel
-	salt := []byte{'c', 'l', 'i', 'p', 't', 'u', 'n', 0}
-	key := pbkdf2.Key([]byte(options.Password), salt, 4096, 32, sha256.New)
-	n := copy(c.secretKey[:], key)
-	if n != 32 {
-		return nil, fmt.Errorf("could not derive key from password")
+	n := copy(c.masterKey[:], key)
+	if n != 32 || len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes long")
 	}
 
 	if typ == CLIENT {
@@ -174,100 +482,279 @@ func NewChannel(typ PeerType, options ChannelOptions) (*Channel, error) {
 		c.peerHeader = CLIENT
 	}
 
-	go c.handleClipboardLoop()
+	if c.sessionFile != "" {
+		if err := c.loadSession(); err != nil {
+			c.errorLogger.Printf("cannot resume session: %s, starting a new one\n", err)
+		}
+	}
+
+	// the peer timeout starts now, as the peer may never show up
+	c.keepalive.lastRecv = time.Now()
+
+	if options.Broadcast {
+		if c.pairing || c.sessionFile != "" || c.streamCompression || c.probeEnabled {
+			return nil, fmt.Errorf("broadcast mode cannot be used with pairing, session files, stream compression or blocksize probing")
+		}
+		if err := c.startBroadcast(options.BroadcastRepeat); err != nil {
+			return nil, err
+		}
+		go c.handleBroadcastLoop()
+	} else {
+		go c.handleClipboardLoop()
+	}
 
-	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt)
 	go func() {
-		force := false
-		for sig := range sigChannel {
-			if sig == os.Interrupt {
-				if force {
-					os.Exit(130)
-				}
-				force = true
-				go c.CloseChannel()
-			}
+		select {
+		case <-ctx.Done():
+			c.abort()
+			c.close(ctx.Err())
+		case <-c.done:
 		}
 	}()
 	return &c, nil
 }
 
 func (c *Channel) packet2string(p CBPacket) (string, error) {
-	var b bytes.Buffer
-	zw := zlib.NewWriter(&b)
-	enc := gob.NewEncoder(zw)
-	err := enc.Encode(p)
-	if err != nil {
-		return "", fmt.Errorf("packet2string: cannot encode data: %s", err)
+	body := encodeFrame(p)
+	var flags byte
+	if p.More {
+		flags |= flagMore
+	}
+	if p.Streamed {
+		// compressing the payload again is not worth it
+		flags |= flagStreamed
+	} else if p.Type != PacketTypeProbe && p.Type != PacketTypeHandshake {
+		// handshake packets are not compressed, as anyone can seal them
+		// (see string2packet)
+		var codec byte
+		var err error
+		body, codec, err = c.compressBody(p, body)
+		if err != nil {
+			return "", fmt.Errorf("packet2string: %s", err)
+		}
+		flags |= codec << flagCodecShift
 	}
-	zw.Close()
 
 	var nonce [24]byte
 	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
 		return "", fmt.Errorf("packet2string: cannot get random bytes for nonce: %s", err)
 	}
-	encrypted := secretbox.Seal(nonce[:], b.Bytes(), &nonce, &c.secretKey)
+	key := &c.sendKey
+	if p.Type == PacketTypeHandshake {
+		key = &handshakeKey
+	}
+	frame := append(c.frameHeader(flags), nonce[:]...)
+	frame = secretbox.Seal(frame, append(c.frameHeader(flags), body...), &nonce, key)
 
-	s := base64.StdEncoding.EncodeToString(encrypted)
+	s := c.encodeText(frame, p.Type == PacketTypeHandshake)
 	return s, nil
 }
 
 func (c *Channel) string2packet(s string) (CBPacket, error) {
-	buf, err := base64.StdEncoding.DecodeString(s)
-	if err != nil || len(buf) < 24 {
-		return CBPacket{}, err
+	buf, err := c.decodeText(s)
+	if err != nil {
+		return CBPacket{}, fmt.Errorf("string2packet: unknown packet encoding")
+	}
+	if len(buf) < frameHeaderSize || string(buf[:2]) != frameMagic {
+		if c.isLegacyPacket(buf) {
+			return CBPacket{}, &versionError{legacy: true}
+		}
+		return CBPacket{}, fmt.Errorf("string2packet: unknown packet format")
+	}
+	version, flags := buf[2], buf[3]
+	headerSize := frameHeaderSize
+	if flags&flagAddressed != 0 {
+		headerSize += addressSize
+	}
+	if len(buf) < headerSize {
+		return CBPacket{}, fmt.Errorf("string2packet: truncated packet")
+	}
+	header, buf := buf[:headerSize], buf[headerSize:]
+	if !bytes.Equal(header[frameHeaderSize:], c.address) {
+		return CBPacket{}, errForeignPacket
+	}
+	if flags&flagVersionNak != 0 {
+		if version == frameVersion || len(buf) != 1 || PeerType(buf[0]) != c.ownHeader {
+			return CBPacket{}, fmt.Errorf("string2packet: ignoring version nak")
+		}
+		return CBPacket{}, &versionError{version: version, nak: true}
+	}
+	if version != frameVersion {
+		return CBPacket{}, &versionError{version: version}
+	}
+	if len(buf) < 24 {
+		return CBPacket{}, fmt.Errorf("string2packet: truncated packet")
 	}
 
 	var decryptNonce [24]byte
 	copy(decryptNonce[:], buf[:24])
-	decrypted, ok := secretbox.Open(nil, buf[24:], &decryptNonce, &c.secretKey)
+	// handshake packets are sealed with a well-known key, all others with
+	// the key of the current session (or the next one during a rekey)
+	handshake := false
+	decrypted, ok := []byte(nil), false
+	if c.handshake.established {
+		decrypted, ok = secretbox.Open(nil, buf[24:], &decryptNonce, &c.recvKey)
+		if !ok {
+			decrypted, ok = secretbox.Open(nil, buf[24:], &decryptNonce, &c.nextRecvKey)
+		}
+	}
 	if !ok {
+		decrypted, ok = secretbox.Open(nil, buf[24:], &decryptNonce, &handshakeKey)
+		handshake = true
+	}
+	if !ok {
+		c.updateStats(func(s *Stats) { s.DecryptionFailures++ })
 		return CBPacket{}, fmt.Errorf("string2packet: cannot decrypt packet")
 	}
+	if len(decrypted) < headerSize || !bytes.Equal(decrypted[:headerSize], header) {
+		return CBPacket{}, fmt.Errorf("string2packet: packet header has been modified")
+	}
 
-	rz, err := zlib.NewReader(bytes.NewReader(decrypted))
+	if handshake && flags>>flagCodecShift != 0 {
+		// handshake packets are only authenticated once decoded, so they
+		// are not decompressed
+		return CBPacket{}, fmt.Errorf("string2packet: compressed handshake packet")
+	}
+	body, err := decompressBody(decrypted[headerSize:], flags>>flagCodecShift)
 	if err != nil {
-		return CBPacket{}, fmt.Errorf("string2packet: cannot decompress packet: %s", err)
+		return CBPacket{}, fmt.Errorf("string2packet: %s", err)
 	}
-	var p CBPacket
-	dec := gob.NewDecoder(rz)
-	err = dec.Decode(&p)
+	p, err := decodeFrame(body)
 	if err != nil {
-		return CBPacket{}, fmt.Errorf("string2packet: cannot decode packet: %s", err)
+		return CBPacket{}, fmt.Errorf("string2packet: %s", err)
+	}
+	p.Streamed = flags&flagStreamed != 0
+	p.More = flags&flagMore != 0
+	if handshake != (p.Type == PacketTypeHandshake) {
+		return CBPacket{}, fmt.Errorf("string2packet: packet does not belong to the current session")
 	}
 	return p, nil
 }
 
-func GetConnData(conn net.Conn, bufferSize int, delay time.Duration) ([]byte, error) {
-	buf := make([]byte, bufferSize)
-	time.Sleep(delay)
-	conn.SetReadDeadline(time.Now().Add(netTimeout))
-	length, err := conn.Read(buf)
+// isLegacyPacket checks whether a packet was sent by a version of cliptun
+// preceding the frame format, which sealed gob encoded packets using the
+// key derived from the password or the handshake key.
+func (c *Channel) isLegacyPacket(buf []byte) bool {
+	if len(buf) < 24 {
+		return false
+	}
+	var nonce [24]byte
+	copy(nonce[:], buf[:24])
+	_, ok := secretbox.Open(nil, buf[24:], &nonce, &c.masterKey)
+	if !ok {
+		_, ok = secretbox.Open(nil, buf[24:], &nonce, &handshakeKey)
+	}
+	return ok
+}
 
-	if err == nil {
-		return buf[0:length], nil
-	} else {
-		// ignore I/O timeouts etc.
-		if nerr, ok := err.(net.Error); ok && (nerr.Temporary() || nerr.Timeout()) {
-			return buf[0:0], nil
+// reportVersionMismatch is called for packets sent by a peer using an
+// incompatible version. As version NAKs are not authenticated (anyone able
+// to write to the transport can send them), they only stop the channel if
+// no packet of the peer has been authenticated yet and the NAKs keep coming
+// in for a while.
+func (c *Channel) reportVersionMismatch(err *versionError) {
+	if err.nak && !c.handshake.established {
+		if c.firstVersionNak.IsZero() {
+			c.firstVersionNak = time.Now()
+		} else if time.Now().Sub(c.firstVersionNak) > 2*c.resyncTimeout() {
+			c.stop(err)
+			return
 		}
-		return buf[0:0], err
+	}
+	if c.reportedVersion == nil {
+		c.reportedVersion = make(map[versionError]bool)
+	}
+	if !c.reportedVersion[*err] {
+		c.reportedVersion[*err] = true
+		c.errorLogger.Println(err)
+	}
+	if !err.legacy && !err.nak && !c.broadcastReceiver() {
+		nak := append(c.frameHeader(flagVersionNak), byte(c.peerHeader))
+		c.writeText(c.encodeText(nak, true))
 	}
 }
 
-func (c *Channel) Receive() []byte {
-	cbdata := <-c.receiveChan
-	return []byte(cbdata.Payload)
+// Receive returns the next data received from the peer. Once the channel
+// has been closed, it returns io.EOF (or the error the channel stopped
+// with).
+func (c *Channel) Receive() ([]byte, error) {
+	select {
+	case cbdata := <-c.receiveChan:
+		return []byte(cbdata.Payload), nil
+	case <-c.done:
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// Send sends data to the peer, split into fragments of at most the current
+// blocksize. Receive on the other side returns the data reassembled.
+func (c *Channel) Send(data []byte) error {
+	_, err := c.send(data, nil)
+	return err
 }
 
-func (c *Channel) Send(data []byte) {
-	c.sendChan <- CBPacket{Target: c.peerHeader, Payload: string(data)}
+// send queues data for sending until cancel is closed, returning the
+// number of bytes queued.
+func (c *Channel) send(data []byte, cancel <-chan struct{}) (int, error) {
+	// keep fragments of concurrent calls from being mixed up
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if c.broadcastReceiver() {
+		return 0, fmt.Errorf("cannot send data while receiving a broadcast")
+	}
+	select {
+	case <-c.done:
+		// the queue may still have room, but nothing is sent anymore
+		return 0, ErrClosed
+	case <-c.aborted:
+		return 0, ErrClosed
+	default:
+	}
+	sent := 0
+	bulk := len(data) > interactiveSize
+	for {
+		n := len(data)
+		if blocksize := c.Blocksize(); n > blocksize {
+			n = blocksize
+		}
+		more := n < len(data)
+		if bulk {
+			if err := c.acquireBulkSlot(cancel); err != nil {
+				return sent, err
+			}
+		}
+		var err error
+		select {
+		case c.sendChan <- CBPacket{Target: c.peerHeader, Payload: string(data[:n]), More: more, cancel: cancel, bulk: bulk}:
+		case <-c.done:
+			err = ErrClosed
+		case <-c.aborted:
+			err = ErrClosed
+		case <-c.writeDeadline.wait():
+			err = timeoutError{}
+		case <-cancel:
+			err = ErrClosed
+		}
+		if err != nil {
+			if bulk {
+				<-c.bulkSlots
+			}
+			return sent, err
+		}
+		sent += n
+		if !more {
+			return sent, nil
+		}
+		data = data[n:]
+	}
 }
 
 func (c *Channel) processControlPacket(packet CBPacket) error {
 	if packet.Type == PacketTypeControl {
-		debugLogger.Println("received cb control data:", packet.Type, packet.Payload)
+		c.debugLogger.Println("received cb control data:", packet.Type, packet.Payload)
 		args := strings.SplitN(packet.Payload, ":", 2)
 		cmd := args[0]
 		arg := ""
@@ -276,13 +763,33 @@ func (c *Channel) processControlPacket(packet CBPacket) error {
 		}
 		switch cmd {
 		case "FIN":
+			c.peerClosed = true
 			c.sendControl("FIN-ACK")
 			c.initiateDelayedShutdown()
 		case "FIN-ACK":
-			c.shutdown()
+			c.stop(nil)
+		case "REKEY", "REKEY-ACK":
+			c.processRekeyPacket(cmd)
+		case "KEEPALIVE":
+			// only sent to show the peer is still there
+		case "BLOCKSIZE":
+			if size, err := strconv.Atoi(arg); err == nil && size > 0 {
+				c.setBlocksizeLimit(size)
+			}
+		case "REPROBE":
+			c.startProbing()
+		case "RESUME":
+			c.peerResumed()
+		case "RESUME-ACK":
+			c.resumeConfirmed()
 		default:
+			if c.resume.pending {
+				c.debugLogger.Println("ignoring control packet sent to the previous process")
+				break
+			}
 			if c.controlPacketCallback == nil {
-				errorLogger.Println("control packet received, but no callback defined")
+				c.errorLogger.Println("control packet received, but no callback defined")
+				break
 			}
 			c.controlPacketCallback(cmd, arg)
 		}
@@ -290,32 +797,164 @@ func (c *Channel) processControlPacket(packet CBPacket) error {
 	return nil
 }
 
+// sendControl queues a control packet, which is sent before the data
+// queued.
 func (c *Channel) sendControl(msg string) {
-	debugLogger.Println("sending control packet:", msg)
+	c.debugLogger.Println("sending control packet:", msg)
 	data := []byte(msg)
-	c.sendChan <- CBPacket{Target: c.peerHeader, Type: PacketTypeControl, Payload: string(data)}
+	select {
+	case c.controlChan <- CBPacket{Target: c.peerHeader, Type: PacketTypeControl, Payload: string(data)}:
+	case <-c.done:
+	}
 }
 
-func (c *Channel) CloseChannel() {
-	c.sendControl("FIN")
-	time.Sleep(8 * c.interval)
-	// fail safe if we do not receive a FIN-ACK in time
-	c.shutdown()
+// Close tells the peer that the channel is being closed once the data
+// passed to Send has been sent, and returns once the peer acknowledged it
+// (or did not answer in time) and the channel has been shut down.
+func (c *Channel) Close() error {
+	c.close(nil)
+	<-c.done
+	return c.Err()
+}
+
+// close closes the channel like Close (without waiting), err is the reason
+// reported by Err.
+func (c *Channel) close(err error) {
+	c.closeOnce.Do(func() {
+		if c.broadcast.enabled && (c.broadcastReceiver() || err != nil || c.isAborted()) {
+			// the peer cannot be told anyway
+			c.stop(err)
+			return
+		}
+		go func() {
+			// the FIN follows the data queued
+			c.debugLogger.Println("sending control packet: FIN")
+			select {
+			case c.sendChan <- CBPacket{Target: c.peerHeader, Type: PacketTypeControl, Payload: "FIN"}:
+			case <-c.done:
+			}
+			timeout := time.After(8 * c.Interval())
+			if c.broadcast.enabled {
+				// the FIN ends the data, which is sent completely before
+				// the channel stops
+				timeout = nil
+			}
+			select {
+			case <-timeout:
+				// fail safe if we do not receive a FIN-ACK in time
+			case <-c.done:
+			}
+			c.stop(err)
+		}()
+	})
+}
+
+// Done returns a channel that is closed once the channel has been shut
+// down, either by Close, by the peer or due to an error.
+func (c *Channel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error the channel has been shut down with, or nil if it
+// is still running or has been closed regularly.
+func (c *Channel) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
 }
 
 func (c *Channel) initiateDelayedShutdown() {
 	c.delayedShutdown.Do(func() {
 		go func() {
-			debugLogger.Println("trying to tear down channel...")
-			time.Sleep(6 * c.interval)
-			c.shutdown()
+			c.debugLogger.Println("trying to tear down channel...")
+			time.Sleep(6 * c.Interval())
+			c.stop(nil)
 		}()
 	})
 }
 
+// stop stops the channel, err is the reason reported by Err.
+func (c *Channel) stop(err error) {
+	c.stopOnce.Do(func() {
+		c.err = err
+		close(c.stopping)
+	})
+}
+
+// shutdown is called by handleClipboardLoop (or handleBroadcastLoop) once
+// the channel has been stopped.
 func (c *Channel) shutdown() {
-	c.transport.Write("")
-	os.Exit(0)
+	if !c.broadcastReceiver() && !c.medium.shared {
+		c.transport.Write("")
+	}
+	if closer, ok := c.transport.(io.Closer); ok {
+		closer.Close()
+	}
+	if c.err == nil && !c.keepSession {
+		// sessions are only resumed after a failure or Suspend
+		c.removeSession()
+	}
+	wipe(c.sendKey[:])
+	wipe(c.recvKey[:])
+	wipe(c.nextRecvKey[:])
+	c.debugLogger.Println("channel closed")
+	close(c.done)
+}
+
+// writePacket encodes a packet and writes it to the transport.
+func (c *Channel) writePacket(p CBPacket) {
+	encoded, err := c.packet2string(p)
+	if err != nil {
+		c.errorLogger.Println("cannot send packet:", err)
+		return
+	}
+	c.writeText(encoded)
+}
+
+// writeText writes an encoded packet to the transport.
+func (c *Channel) writeText(s string) {
+	c.lastText = ""
+	c.appendText(s)
+}
+
+// appendText writes an encoded packet to the transport, following the
+// packets written since the last call of writeText. This makes a
+// difference only for transports keeping just the last content written.
+func (c *Channel) appendText(s string) {
+	c.keepalive.lastSent = time.Now()
+	wrapped := wrapText(s, c.wrap)
+	text := wrapped
+	if c.lastText != "" {
+		text = c.lastText + "\n" + wrapped
+	}
+	c.lastText = text
+	if err := c.transport.Write(text); err != nil {
+		if c.peerClosed {
+			// the peer may have closed the transport already
+			c.debugLogger.Println("cannot write to transport:", err)
+		} else {
+			c.errorLogger.Println("cannot write to transport:", err)
+		}
+		return
+	}
+	c.updateStats(func(s *Stats) {
+		s.PacketsSent++
+		s.BytesSent += int64(len(wrapped))
+	})
+}
+
+// selectiveAcks returns the sequence numbers of all packets received out
+// of order, i.e. waiting in receiveQueue for a missing predecessor.
+func (c *Channel) selectiveAcks() []int {
+	var sacks []int
+	for seq := range c.receiveQueue {
+		sacks = append(sacks, seq)
+	}
+	sort.Ints(sacks)
+	return sacks
 }
 
 func (c *Channel) handleClipboardLoop() {
@@ -325,119 +964,280 @@ func (c *Channel) handleClipboardLoop() {
 	var lastAcked = -1
 	var lastRecvTime = time.Now()
 	var lastSendTime = time.Now()
+	var peerSAcks = make(map[int]bool)
+	// send times of packets not retransmitted yet, for measuring the rtt
+	var sendTimes = make(map[int]time.Time)
+	// control packets in flight, which do not count towards the send window
+	var controlSent = make(map[int]bool)
+
+	if c.resume.pending {
+		lastSendIndex, lastRecvIndex, lastAckReceived = c.resume.sendIndex, c.resume.recvIndex, c.resume.ackReceived
+		lastAcked = lastRecvIndex
+	}
 
 	mrand.Seed(time.Now().UnixNano())
 
 	for {
-		time.Sleep(c.interval)
-		content, err := c.transport.Read()
-		// if err != nil {
-		// errorLogger.Println("cannot read from transport:", err)
-		// goto SkipPacket
-		// }
-		if content != "" {
-			packet, err := c.string2packet(content)
+		interval := c.Interval()
+		select {
+		case <-c.stopping:
+			c.shutdown()
+			return
+		case <-time.After(interval):
+		}
+		content, _ := c.transport.Read()
+		marked := strings.Contains(content, transport.PacketBegin)
+		foreign := false
+		for _, data := range extractPackets(content) {
+			if data == "" {
+				continue
+			}
+			packet, err := c.string2packet(data)
+			if err == errForeignPacket {
+				foreign = true
+				continue
+			}
+			if verr, ok := err.(*versionError); ok {
+				c.reportVersionMismatch(verr)
+				continue
+			}
 			if err != nil {
-				debugLogger.Println("cannot read packet from clipboard:", err)
-				goto SkipPacket
+				c.debugLogger.Println("cannot read packet from clipboard:", err)
+				if marked {
+					c.countDecodeFailure(true)
+				}
+				continue
+			}
+			if packet.Target != c.ownHeader {
+				continue
+			}
+			c.updateStats(func(s *Stats) {
+				s.PacketsReceived++
+				s.BytesReceived += int64(len(data))
+			})
+			c.countDecodeFailure(false)
+			if packet.Type == PacketTypeHandshake {
+				c.processHandshakePacket(packet)
+				continue
+			}
+			if packet.Session != c.session {
+				c.debugLogger.Println("ignoring packet from unknown session")
+				continue
+			}
+			if !c.handshake.confirmed {
+				// the first packet of the session from the client
+				c.sessionConfirmed()
+			}
+			c.peerAlive()
+			if packet.Type == PacketTypeProbe {
+				c.processProbePacket(packet)
+				continue
+			}
+			if packet.Type == PacketTypeParity {
+				c.processParityPacket(packet, lastRecvIndex)
 			}
-			if packet.Target == c.ownHeader {
-				idx := packet.Seq
-				if packet.Ack > lastAckReceived {
-					lastAckReceived = packet.Ack
+			for ; lastAckReceived < packet.Ack; lastAckReceived++ {
+				seq := lastAckReceived + 1
+				if sent, ok := sendTimes[seq]; ok {
+					c.updateRTT(time.Now().Sub(sent))
+					delete(sendTimes, seq)
 				}
-				if idx == lastRecvIndex+1 {
-					lastRecvIndex++
-					c.receiveQueue[lastRecvIndex] = packet
-					lastRecvTime = time.Now()
-					if packet.Type == PacketTypeControl {
-						c.processControlPacket(packet)
+				delete(c.sendQueue, seq)
+				delete(peerSAcks, seq)
+				delete(controlSent, seq)
+				c.tuneAcked()
+			}
+			c.fecAcknowledged(lastAckReceived)
+			for _, seq := range packet.SAck {
+				if seq > lastAckReceived {
+					peerSAcks[seq] = true
+				}
+			}
+			if packet.Type != PacketTypeParity && packet.Seq > lastRecvIndex {
+				c.receiveQueue[packet.Seq] = packet
+				c.fecReceived(packet)
+			}
+			c.recoverPackets(lastRecvIndex)
+			// deliver all packets that are now in order
+			for {
+				packet, ok := c.receiveQueue[lastRecvIndex+1]
+				if !ok {
+					break
+				}
+				lastRecvIndex++
+				delete(c.receiveQueue, lastRecvIndex)
+				lastRecvTime = time.Now()
+				c.countTraffic(packet)
+				if err := c.decompressStream(&packet); err != nil {
+					c.stop(err)
+					break
+				}
+				if packet.Type == PacketTypeControl {
+					c.processControlPacket(packet)
+				} else if c.resume.pending {
+					// data sent to the previous process, skip it
+				} else if packet.More {
+					c.fragments = append(c.fragments, packet.Payload...)
+				} else if len(c.fragments) == 0 || packet.Payload != "" {
+					// empty packets in the middle of fragmented data are
+					// only sent to acknowledge packets, skip them
+					if len(c.fragments) > 0 {
+						packet.Payload = string(append(c.fragments, packet.Payload...))
+						c.fragments = nil
+					}
+					if packet.Payload != "" {
+						c.updateStats(func(s *Stats) { s.DataReceived += int64(len(packet.Payload)) })
+						select {
+						case c.receiveChan <- packet:
+						case <-c.stopping:
+						}
 					} else {
-						if packet.Payload != "" {
-							c.receiveChan <- packet
-						} else {
-							select {
-							case c.receiveChan <- packet:
-							default:
-							}
+						select {
+						case c.receiveChan <- packet:
+						default:
 						}
 					}
 				}
-				traceLogger.Printf("\tlastRecvIndex: %d (%s) (%s), lastSendIndex: %d (%s), lastACK: %d\n",
-					lastRecvIndex, humanize.Bytes(uint64(len(content))), lastRecvTime.Format("15:04:05"),
-					lastSendIndex, lastSendTime.Format("15:04:05"),
-					lastAckReceived)
 			}
+			c.traceLogger.Printf("\tlastRecvIndex: %d (%s) (%s), lastSendIndex: %d (%s), lastACK: %d, in flight: %d\n",
+				lastRecvIndex, humanize.Bytes(uint64(len(data))), lastRecvTime.Format("15:04:05"),
+				lastSendIndex, lastSendTime.Format("15:04:05"),
+				lastAckReceived, lastSendIndex-lastAckReceived)
+		}
+		c.senseMedium(content, foreign)
+		c.saveSession(lastSendIndex, lastRecvIndex, lastAckReceived)
+
+		if c.checkResume() {
+			lastRecvIndex, lastSendIndex, lastAckReceived, lastAcked = -1, -1, -1, -1
+			peerSAcks = make(map[int]bool)
+			sendTimes = make(map[int]time.Time)
+			controlSent = make(map[int]bool)
+			c.resume.saved = [3]int{-1, -1, -1}
+			c.resetFEC()
+		}
+		c.checkPeerTimeout()
+		if c.mediumBusy() {
+			continue
+		}
+		c.sendHandshake()
+		if !c.handshake.confirmed {
+			continue
+		}
+		c.checkRekey()
+		c.checkKeepalive()
+		if c.checkProbe() {
+			continue
 		}
-	SkipPacket:
 
 		if lastAckReceived < lastSendIndex {
-			if time.Now().Sub(lastSendTime) > 4*c.interval {
-				errorLogger.Println("out of sync, trying to resync...")
+			// once the peer sent a FIN, it stops as soon as the FIN-ACK
+			// arrives, without acknowledging the packets sent along with it
+			if time.Now().Sub(lastSendTime) > c.resyncTimeout() && !c.peerClosed {
+				c.errorLogger.Println("out of sync, trying to resync...")
+				c.updateStats(func(s *Stats) { s.Resyncs++ })
+				c.tuneResync()
 				// wait for random time to avoid collisions
-				time.Sleep(c.interval * time.Duration(mrand.Intn(4)))
-				debugLogger.Println("resetting transport")
-				c.transport.Reset()
-				time.Sleep(3 * c.interval)
+				time.Sleep(interval * time.Duration(mrand.Intn(4)))
+				if !c.medium.shared {
+					// the packets of other pairs must not be cleared
+					c.debugLogger.Println("resetting transport")
+					c.transport.Reset()
+				}
+				time.Sleep(3 * interval)
 				lastSendTime = time.Now()
-				pdata, err := c.packet2string(c.sendQueue[lastSendIndex])
-				if err == nil {
-					err := c.transport.Write(pdata)
+				// only retransmit packets the peer has not acknowledged selectively
+				follow := false
+				for seq := lastAckReceived + 1; seq <= lastSendIndex; seq++ {
+					if peerSAcks[seq] {
+						continue
+					}
+					delete(sendTimes, seq)
+					packet := c.sendQueue[seq]
+					packet.Ack = lastRecvIndex
+					packet.SAck = c.selectiveAcks()
+					lastAcked = lastRecvIndex
+					encoded, err := c.packet2string(packet)
 					if err != nil {
-						errorLogger.Println("cannot write to transport:", err)
+						c.errorLogger.Println("cannot send packet:", err)
+						continue
 					}
-				} else {
-					errorLogger.Println("cannot send packet:", err)
+					c.writeFollowing(encoded, follow)
+					follow = true
+					c.updateStats(func(s *Stats) { s.Retransmissions++ })
 				}
 				continue
-			} else {
-				debugLogger.Println("last packet not acknowledged, waiting and trying again...")
 			}
-			continue
-		}
-		// last packet acked, we may send something new
-
-		var cbdata CBPacket
-		var newData bool
-		select {
-		case cbdata = <-c.sendChan:
-			newData = true
-		default:
-			newData = false
-		}
-		if !newData {
-			if lastAcked < lastRecvIndex {
-				debugLogger.Println("acknowledgement outstanding, sending empty packet")
-				cbdata = CBPacket{Target: c.peerHeader, Payload: ""}
-			} else {
-				continue
+			if lastSendIndex-lastAckReceived-len(controlSent) >= c.window {
+				c.debugLogger.Println("send window full, waiting and trying again...")
 			}
 		}
+		// control packets are sent even if the send window is exhausted,
+		// new data only if it is not
 
-		lastSendIndex++
-		cbdata.Seq = lastSendIndex
-		cbdata.Ack = lastRecvIndex
-		lastAcked = lastRecvIndex
-		c.sendQueue[lastSendIndex] = cbdata
-		encoded, err := c.packet2string(cbdata)
+		for {
+			windowFull := lastSendIndex-lastAckReceived-len(controlSent) >= c.window
+			if c.fec.clipboard && lastSendIndex-lastAckReceived-len(controlSent) > 0 &&
+				time.Now().Sub(lastSendTime) < c.resyncTimeout()/2 {
+				// the next packet replaces the one in flight on the
+				// clipboard, so wait for the acknowledgement for a while
+				windowFull = true
+			}
+			cbdata, newData := c.nextPacket(windowFull)
+			if !newData {
+				if windowFull {
+					break
+				} else if lastAcked < lastRecvIndex {
+					c.debugLogger.Println("acknowledgement outstanding, sending empty packet")
+					cbdata = CBPacket{Target: c.peerHeader, Payload: ""}
+				} else if lastSendIndex < 0 {
+					c.debugLogger.Println("confirming session, sending empty packet")
+					cbdata = CBPacket{Target: c.peerHeader, Payload: ""}
+				} else {
+					break
+				}
+			}
 
-		if err == nil {
-			err := c.transport.Write(encoded)
+			if newData && cbdata.Type == PacketTypeData {
+				c.updateStats(func(s *Stats) { s.DataSent += int64(len(cbdata.Payload)) })
+			}
+			if err := c.compressStream(&cbdata); err != nil {
+				c.stop(err)
+				break
+			}
+			inFlight := lastSendIndex > lastAckReceived
+			lastSendIndex++
+			if cbdata.Type == PacketTypeControl {
+				controlSent[lastSendIndex] = true
+			}
+			cbdata.Session = c.session
+			cbdata.Seq = lastSendIndex
+			cbdata.Ack = lastRecvIndex
+			cbdata.SAck = c.selectiveAcks()
+			lastAcked = lastRecvIndex
+			c.sendQueue[lastSendIndex] = cbdata
+			encoded, err := c.packet2string(cbdata)
 			if err != nil {
-				errorLogger.Println("cannot write to transport:", err)
+				c.errorLogger.Println("cannot send packet:", err)
+			}
+			c.countTraffic(cbdata)
+			if isRekeyPacket(cbdata) {
+				// all following packets use the next key
+				c.advanceSendKey()
+			}
+			// the sequence number must not be reused after a restart
+			c.saveSession(lastSendIndex, lastRecvIndex, lastAckReceived)
+			if err == nil {
+				// with forward error correction, a packet in flight on
+				// the clipboard is replaced, it can be reconstructed if
+				// it got lost
+				c.writeFollowing(encoded, inFlight && !(c.fec.clipboard && cbdata.Type != PacketTypeControl))
+				c.appendParity()
 			}
-		} else {
-			errorLogger.Println("cannot send packet:", err)
-		}
-
-		lastSendTime = time.Now()
 
-		// clear queue buffer
-		if lastRecvIndex >= QueueSize {
-			delete(c.receiveQueue, lastRecvIndex-QueueSize)
-		}
-		if lastSendIndex >= QueueSize {
-			delete(c.sendQueue, lastSendIndex-QueueSize)
+			lastSendTime = time.Now()
+			sendTimes[lastSendIndex] = lastSendTime
+			c.addToGroup(cbdata)
 		}
+		c.checkParity(lastSendIndex-lastAckReceived >= c.window, lastSendTime, lastAckReceived)
 	}
 }
@@ -0,0 +1,39 @@
+package channel
+
+import (
+	"testing"
+)
+
+func TestControlPacketCallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		payload  string
+		callback bool
+		pending  bool
+		// the command and argument passed to the callback, if any
+		want []string
+	}{
+		{"no callback", "SOCKS:1080", false, false, nil},
+		{"callback", "SOCKS:1080", true, false, []string{"SOCKS", "1080"}},
+		{"colon in argument", "FWD:a:b", true, false, []string{"FWD", "a:b"}},
+		{"no argument", "PING", true, false, []string{"PING", ""}},
+		{"session resumed", "SOCKS:1080", true, true, nil},
+		{"handled by the channel", "KEEPALIVE", true, false, nil},
+	}
+	for _, tt := range tests {
+		c := testChannel(CLIENT, "")
+		c.debugLogger = newLevelLogger(nil, LevelDebug)
+		c.errorLogger = newLevelLogger(nil, LevelError)
+		c.resume.pending = tt.pending
+		var got []string
+		if tt.callback {
+			c.controlPacketCallback = func(cmd, arg string) { got = []string{cmd, arg} }
+		}
+		if err := c.processControlPacket(CBPacket{Type: PacketTypeControl, Payload: tt.payload}); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if len(got) != len(tt.want) || len(got) > 0 && (got[0] != tt.want[0] || got[1] != tt.want[1]) {
+			t.Errorf("%s: callback got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package channel
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v3"
+)
+
+const (
+	// codec used until the peers agreed on one, must be supported by all
+	// versions
+	defaultCodec = "zlib"
+	// number of data packets sent uncompressed after compression did not
+	// shrink the payload of a data packet of at least incompressibleMinSize
+	// bytes (the overhead of the codecs exceeds the savings for smaller
+	// bodies anyway)
+	incompressibleSkip    = 8
+	incompressibleMinSize = 256
+	// upper bound for the decompressed body of a frame, so packets cannot
+	// exhaust the memory by decompressing to huge sizes
+	maxBodySize = BlocksizeLimit + 1024
+)
+
+// codec compresses the body of frames. The IDs are part of the wire
+// format, new codecs must use new IDs.
+type codec struct {
+	id        byte
+	name      string
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.Reader, error)
+}
+
+var codecs = []*codec{
+	{id: 0, name: "none"},
+	{
+		id:        1,
+		name:      "zlib",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	},
+	{
+		id:        2,
+		name:      "deflate",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		newReader: func(r io.Reader) (io.Reader, error) { return flate.NewReader(r), nil },
+	},
+	{
+		id:        3,
+		name:      "brotli",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return brotli.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	},
+	{
+		id:   4,
+		name: "zstd",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.Reader, error) {
+			// the window announced by the frame is allocated upfront
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxBodySize))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	{
+		id:        5,
+		name:      "lz4",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return lz4.NewWriter(w), nil },
+		newReader: func(r io.Reader) (io.Reader, error) { return lz4.NewReader(r), nil },
+	},
+}
+
+func codecByName(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func codecByID(id byte) *codec {
+	for _, c := range codecs {
+		if c.id == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// CodecNames returns the names of all supported compression codecs.
+func CodecNames() []string {
+	var names []string
+	for _, c := range codecs {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func (c *codec) compress(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := c.newWriter(&b)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *codec) decompress(data []byte) ([]byte, error) {
+	r, err := c.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		// the zstd decoder runs in a goroutine until closed
+		defer closer.Close()
+	}
+	// read one byte more than allowed to detect bodies exceeding the limit
+	data, err = ioutil.ReadAll(io.LimitReader(r, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBodySize {
+		return nil, fmt.Errorf("packet exceeds %d bytes", maxBodySize)
+	}
+	return data, nil
+}
+
+// compressBody compresses the body of a frame, returning the ID of the
+// codec used. Packets that do not shrink are sent uncompressed. If the
+// payload of a large data packet does not shrink, the following data
+// packets are not even tried to be compressed for a while, as they most
+// likely contain incompressible data as well. Acknowledgements and other
+// small packets do not affect this, as they rarely shrink.
+func (c *Channel) compressBody(p CBPacket, body []byte) ([]byte, byte, error) {
+	if c.codec.newWriter == nil {
+		return body, 0, nil
+	}
+	data := p.Type == PacketTypeData && p.Payload != ""
+	if data && c.incompressible > 0 {
+		c.incompressible--
+		return body, 0, nil
+	}
+	compressed, err := c.codec.compress(body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot compress packet: %s", err)
+	}
+	if len(compressed) >= len(body) {
+		if data && len(p.Payload) >= incompressibleMinSize {
+			c.incompressible = incompressibleSkip
+		}
+		return body, 0, nil
+	}
+	return compressed, c.codec.id, nil
+}
+
+func decompressBody(body []byte, id byte) ([]byte, error) {
+	if id == 0 {
+		return body, nil
+	}
+	codec := codecByID(id)
+	if codec == nil {
+		return nil, fmt.Errorf("unknown compression codec %d", id)
+	}
+	decompressed, err := codec.decompress(body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress packet: %s", err)
+	}
+	return decompressed, nil
+}
+
+// selectCodec selects the codec for sending packets once the codecs
+// supported by the peer are known.
+func (c *Channel) selectCodec(peerCodecs string) {
+	name := c.compression
+	supported := false
+	for _, peerCodec := range strings.Split(peerCodecs, ",") {
+		if peerCodec == name {
+			supported = true
+		}
+	}
+	if !supported {
+		c.errorLogger.Printf("peer does not support compression codec %s, using %s\n", name, defaultCodec)
+		name = defaultCodec
+	}
+	c.codec = codecByName(name)
+	c.debugLogger.Println("using compression codec", name)
+}
+
+func supportedCodecs() string {
+	return strings.Join(CodecNames(), ",")
+}
@@ -0,0 +1,92 @@
+package channel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+)
+
+func TestCodecRoundtrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.Read(random)
+	data := [][]byte{{}, []byte("a"), bytes.Repeat([]byte("cliptun "), 1000), random}
+	for _, codec := range codecs[1:] {
+		for _, d := range data {
+			compressed, err := codec.compress(d)
+			if err != nil {
+				t.Errorf("%s: %s", codec.name, err)
+				continue
+			}
+			got, err := codec.decompress(compressed)
+			if err != nil {
+				t.Errorf("%s: %s", codec.name, err)
+				continue
+			}
+			if !bytes.Equal(got, d) {
+				t.Errorf("%s: got %d bytes, want %d", codec.name, len(got), len(d))
+			}
+			// frames are authenticated, truncated bodies must not go
+			// unnoticed nevertheless
+			if got, err := codec.decompress(compressed[:len(compressed)/2]); err == nil && len(d) > 0 && bytes.Equal(got, d) {
+				t.Errorf("%s: truncated body of %d bytes decompressed to the complete data", codec.name, len(d))
+			}
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	for _, codec := range codecs[1:] {
+		compressed, err := codec.compress(make([]byte, maxBodySize+1))
+		if err != nil {
+			t.Fatalf("%s: %s", codec.name, err)
+		}
+		if _, err := codec.decompress(compressed); err == nil {
+			t.Errorf("%s: body exceeding the limit decompressed without error", codec.name)
+		}
+	}
+}
+
+func TestIncompressibleSkip(t *testing.T) {
+	random := make([]byte, 2*incompressibleMinSize)
+	rand.Read(random)
+	text := strings.Repeat("hello world ", 100)
+	tests := []struct {
+		name string
+		// packets sent before the packet checked
+		before     []CBPacket
+		compressed bool
+	}{
+		{"compressible", nil, true},
+		{"after acks", []CBPacket{{Ack: 5}, {Ack: 6, SAck: []int{8}}, {Type: PacketTypeControl, Payload: "FIN"}}, true},
+		{"after small random payload", []CBPacket{{Payload: string(random[:incompressibleMinSize-1])}}, true},
+		{"after large random payload", []CBPacket{{Payload: string(random)}}, false},
+		{"acks do not count", append([]CBPacket{{Payload: string(random)}}, make([]CBPacket, incompressibleSkip)...), false},
+		{"skip over", append([]CBPacket{{Payload: string(random)}}, dataPackets(incompressibleSkip, "x")...), true},
+	}
+	for _, tt := range tests {
+		c := &Channel{codec: codecByName("zlib")}
+		for _, p := range tt.before {
+			if _, _, err := c.compressBody(p, encodeFrame(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p := CBPacket{Seq: 1, Payload: text}
+		_, id, err := c.compressBody(p, encodeFrame(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := id != 0; compressed != tt.compressed {
+			t.Errorf("%s: compressed %v, want %v", tt.name, compressed, tt.compressed)
+		}
+	}
+}
+
+// dataPackets returns n data packets with the given payload.
+func dataPackets(n int, payload string) []CBPacket {
+	packets := make([]CBPacket, n)
+	for i := range packets {
+		packets[i].Payload = payload
+	}
+	return packets
+}
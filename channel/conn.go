@@ -0,0 +1,162 @@
+package channel
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Channel implements net.Conn, so it can be used by any protocol running
+// over a stream (like ssh or TLS). Read and Receive must not be used
+// together, as Read keeps data not fitting into the buffer passed until
+// the next call.
+var _ net.Conn = (*Channel)(nil)
+
+// Addr is the address of a peer of a channel.
+type Addr struct {
+	Peer PeerType
+}
+
+func (a Addr) Network() string {
+	return "cliptun"
+}
+
+func (a Addr) String() string {
+	if a.Peer == CLIENT {
+		return "client"
+	}
+	return "server"
+}
+
+// timeoutError is returned by Read and Write once the deadline has passed.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// deadline implements a deadline of net.Conn, wait returns a channel that
+// is closed once the deadline has passed.
+type deadline struct {
+	mutex   sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() deadline {
+	return deadline{expired: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// the timer fired already, wait until it closed the channel
+		<-d.expired
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.expired:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.expired = make(chan struct{})
+		}
+		ch := d.expired
+		d.timer = time.AfterFunc(dur, func() { close(ch) })
+		return
+	}
+	if !expired {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.expired
+}
+
+// Read reads data received from the peer. It returns io.EOF once the
+// channel has been closed.
+func (c *Channel) Read(b []byte) (int, error) {
+	return c.read(b, nil)
+}
+
+// read reads data received from the peer, until cancel is closed.
+func (c *Channel) read(b []byte, cancel <-chan struct{}) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for len(c.readBuffer) == 0 {
+		select {
+		case p := <-c.receiveChan:
+			c.readBuffer = []byte(p.Payload)
+		case <-c.done:
+			if err := c.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		case <-c.readDeadline.wait():
+			return 0, timeoutError{}
+		case <-cancel:
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, c.readBuffer)
+	c.readBuffer = c.readBuffer[n:]
+	return n, nil
+}
+
+// discardReadBuffer drops data read from the channel but not returned by
+// Read yet.
+func (c *Channel) discardReadBuffer() {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	c.readBuffer = nil
+}
+
+// Write sends data to the peer, like Send.
+func (c *Channel) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return c.send(b, nil)
+}
+
+func (c *Channel) LocalAddr() net.Addr {
+	return Addr{c.ownHeader}
+}
+
+func (c *Channel) RemoteAddr() net.Addr {
+	return Addr{c.peerHeader}
+}
+
+func (c *Channel) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *Channel) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *Channel) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,278 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/svent/cliptun/transport"
+)
+
+const (
+	// encoding used if none is configured on either side
+	defaultEncoding = "base64"
+	// handshake packets are always sent using an encoding that survives
+	// every clipboard, as the peers have not agreed on one yet
+	handshakeEncoding = "base32"
+)
+
+// textEncoding converts frames to text that can be written to the
+// transport. The encoded text must not contain the characters of
+// transport.PacketBegin and transport.PacketEnd or whitespace.
+type textEncoding struct {
+	name   string
+	encode func([]byte) string
+	decode func(string) ([]byte, error)
+}
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var encodings = []*textEncoding{
+	{
+		name:   "base64",
+		encode: base64.StdEncoding.EncodeToString,
+		decode: base64.StdEncoding.DecodeString,
+	},
+	{
+		name:   "base64url",
+		encode: base64.RawURLEncoding.EncodeToString,
+		decode: base64.RawURLEncoding.DecodeString,
+	},
+	{
+		name:   "base85",
+		encode: encodeBase85,
+		decode: decodeBase85,
+	},
+	{
+		name:   "base32",
+		encode: base32Encoding.EncodeToString,
+		// some clipboards do not preserve the case
+		decode: func(s string) ([]byte, error) { return base32Encoding.DecodeString(strings.ToUpper(s)) },
+	},
+	{
+		name:   "unicode",
+		encode: encodeUnicode,
+		decode: decodeUnicode,
+	},
+}
+
+func encodingByName(name string) *textEncoding {
+	for _, e := range encodings {
+		if e.name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// EncodingNames returns the names of all supported text encodings.
+func EncodingNames() []string {
+	var names []string
+	for _, e := range encodings {
+		names = append(names, e.name)
+	}
+	return names
+}
+
+func encodeBase85(data []byte) string {
+	buf := make([]byte, ascii85.MaxEncodedLen(len(data)))
+	n := ascii85.Encode(buf, data)
+	return string(buf[:n])
+}
+
+func decodeBase85(s string) ([]byte, error) {
+	buf := make([]byte, 4*len(s))
+	n, _, err := ascii85.Decode(buf, []byte(s), true)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// The unicode encoding stores 14 bits per character, using the CJK
+// ideographs starting at unicodeBase. If the bits of the last character
+// would contain another (incomplete) byte, unicodePadding is appended to
+// mark it as padding. This is much denser than base64 for clipboards
+// counting characters instead of bytes (e.g. Windows, using UTF-16).
+const (
+	unicodeBase    = 0x4e00
+	unicodeBits    = 14
+	unicodePadding = 0x3400
+)
+
+func encodeUnicode(data []byte) string {
+	var b strings.Builder
+	var acc uint32
+	var bits uint
+	for _, c := range data {
+		acc = acc<<8 | uint32(c)
+		bits += 8
+		for bits >= unicodeBits {
+			bits -= unicodeBits
+			b.WriteRune(rune(unicodeBase + (acc>>bits)&(1<<unicodeBits-1)))
+		}
+		acc &= 1<<bits - 1
+	}
+	if bits > 0 {
+		b.WriteRune(rune(unicodeBase + (acc<<(unicodeBits-bits))&(1<<unicodeBits-1)))
+		if unicodeBits-bits >= 8 {
+			b.WriteRune(unicodePadding)
+		}
+	}
+	return b.String()
+}
+
+func decodeUnicode(s string) ([]byte, error) {
+	if !utf8.ValidString(s) {
+		return nil, fmt.Errorf("invalid UTF-8")
+	}
+	var buf bytes.Buffer
+	var acc uint32
+	var bits uint
+	padded := false
+	for _, r := range s {
+		if padded {
+			return nil, fmt.Errorf("padding before end of data")
+		}
+		if r == unicodePadding {
+			padded = true
+			continue
+		}
+		if r < unicodeBase || r >= unicodeBase+1<<unicodeBits {
+			return nil, fmt.Errorf("invalid character %U", r)
+		}
+		acc = acc<<unicodeBits | uint32(r-unicodeBase)
+		bits += unicodeBits
+		for bits >= 8 {
+			bits -= 8
+			buf.WriteByte(byte(acc >> bits))
+		}
+		acc &= 1<<bits - 1
+	}
+	data := buf.Bytes()
+	if padded {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("padding without data")
+		}
+		data = data[:len(data)-1]
+	}
+	return data, nil
+}
+
+// encodeText encodes a frame, using the agreed encoding for packets of
+// the session.
+func (c *Channel) encodeText(frame []byte, handshake bool) string {
+	if handshake {
+		return encodingByName(handshakeEncoding).encode(frame)
+	}
+	return c.encoding.encode(frame)
+}
+
+// decodeText decodes a packet read from the transport. As the encoding of
+// handshake packets differs from the one of the session (and the peer
+// might have switched to the new encoding already), all encodings are
+// tried until one results in a frame.
+func (c *Channel) decodeText(s string) ([]byte, error) {
+	for _, e := range append([]*textEncoding{c.encoding}, encodings...) {
+		buf, err := e.decode(s)
+		if err == nil && len(buf) >= frameHeaderSize && string(buf[:2]) == frameMagic {
+			return buf, nil
+		}
+	}
+	// packets of versions preceding the frame format used base64
+	return base64.StdEncoding.DecodeString(s)
+}
+
+// wrapText encloses an encoded packet in the packet markers, optionally
+// wrapping it into lines of the given width.
+func wrapText(s string, width int) string {
+	var b strings.Builder
+	b.WriteString(transport.PacketBegin)
+	if width > 0 {
+		n := 0
+		for _, r := range s {
+			if n > 0 && n%width == 0 {
+				b.WriteString("\n")
+			}
+			b.WriteRune(r)
+			n++
+		}
+	} else {
+		b.WriteString(s)
+	}
+	b.WriteString(transport.PacketEnd)
+	return b.String()
+}
+
+// extractPackets returns the encoded packets found in the content read
+// from the transport, removing all whitespace inserted on the way (e.g.
+// line breaks added by terminals or remote desktop clients).
+func extractPackets(content string) []string {
+	if !strings.Contains(content, transport.PacketBegin) {
+		// packets of versions preceding the packet markers were separated
+		// by newlines
+		return strings.Fields(content)
+	}
+	var packets []string
+	for {
+		i := strings.Index(content, transport.PacketBegin)
+		if i < 0 {
+			break
+		}
+		content = content[i+len(transport.PacketBegin):]
+		j := strings.Index(content, transport.PacketEnd)
+		if j < 0 {
+			break
+		}
+		packet := content[:j]
+		if k := strings.LastIndex(packet, transport.PacketBegin); k >= 0 {
+			// the end of the previous packet got lost
+			packet = packet[k+len(transport.PacketBegin):]
+		}
+		packets = append(packets, strings.Join(strings.Fields(packet), ""))
+		content = content[j+len(transport.PacketEnd):]
+	}
+	return packets
+}
+
+// selectEncoding returns the encoding both sides use for the session. The
+// client proposes its configured encoding, which the server uses unless it
+// has been configured to use another one supported by the client.
+func (c *Channel) selectEncoding(proposed, peerEncodings string) string {
+	supported := false
+	for _, name := range strings.Split(peerEncodings, ",") {
+		if name == c.configuredEncoding {
+			supported = true
+		}
+	}
+	switch {
+	case c.configuredEncoding != "" && supported:
+		return c.configuredEncoding
+	case encodingByName(proposed) != nil:
+		if c.configuredEncoding != "" {
+			c.errorLogger.Printf("peer does not support encoding %s, using %s\n", c.configuredEncoding, proposed)
+		}
+		return proposed
+	default:
+		return defaultEncoding
+	}
+}
+
+// useEncoding switches to the encoding agreed on for the session.
+func (c *Channel) useEncoding(name string) {
+	e := encodingByName(name)
+	if e == nil {
+		c.errorLogger.Printf("peer selected unknown encoding %s, using %s\n", name, defaultEncoding)
+		e = encodingByName(defaultEncoding)
+	}
+	c.encoding = e
+	c.debugLogger.Println("using encoding", e.name)
+}
+
+func supportedEncodings() string {
+	return strings.Join(EncodingNames(), ",")
+}
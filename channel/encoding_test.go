@@ -0,0 +1,132 @@
+package channel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/svent/cliptun/transport"
+)
+
+func TestEncodingRoundtrip(t *testing.T) {
+	var data [][]byte
+	for n := 0; n < 20; n++ {
+		data = append(data, bytes.Repeat([]byte{0xa5}, n))
+	}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	data = append(data, all, []byte{0, 0, 0, 0}, []byte{0xff, 0xff, 0xff, 0xff, 0xff})
+	for _, e := range encodings {
+		for _, d := range data {
+			s := e.encode(d)
+			if strings.Contains(s, transport.PacketBegin) || strings.Contains(s, transport.PacketEnd) || strings.ContainsAny(s, " \t\r\n") {
+				t.Errorf("%s: encoding of %x contains reserved characters: %q", e.name, d, s)
+			}
+			got, err := e.decode(s)
+			if err != nil {
+				t.Errorf("%s: cannot decode %x: %s", e.name, d, err)
+				continue
+			}
+			if !bytes.Equal(got, d) {
+				t.Errorf("%s: got %x, want %x", e.name, got, d)
+			}
+		}
+	}
+}
+
+func TestEncodingInvalid(t *testing.T) {
+	tests := []struct {
+		encoding string
+		s        string
+	}{
+		{"base64", "QUJD!"},
+		{"base64", "QUJDRA="},
+		{"base64url", "QUJD+A"},
+		{"base64url", "Q"},
+		{"base85", "87cU{"},
+		{"base85", "87cUR~"},
+		{"base32", "IFBE1"},
+		{"base32", "IFB="},
+		{"unicode", "abc"},
+		{"unicode", "\xe4\xb8"},
+		{"unicode", string([]rune{unicodeBase, unicodePadding, unicodeBase})},
+		{"unicode", string([]rune{unicodePadding})},
+		{"unicode", string([]rune{unicodeBase + 1<<unicodeBits})},
+	}
+	for _, tt := range tests {
+		if got, err := encodingByName(tt.encoding).decode(tt.s); err == nil {
+			t.Errorf("%s: %q decoded without error to %x", tt.encoding, tt.s, got)
+		}
+	}
+}
+
+func TestBase32Case(t *testing.T) {
+	e := encodingByName("base32")
+	data := []byte("clipboard tunnel")
+	got, err := e.decode(strings.ToLower(e.encode(data)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("got %q, %v, want %q", got, err, data)
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	frame := append([]byte(frameMagic+"\x01\x00"), bytes.Repeat([]byte{0x5a}, 40)...)
+	for _, session := range encodings {
+		c := &Channel{encoding: session}
+		for _, e := range encodings {
+			s := e.encode(frame)
+			got, err := c.decodeText(s)
+			if err != nil || !bytes.Equal(got, frame) {
+				t.Errorf("session %s, frame %s: got %x, %v", session.name, e.name, got, err)
+			}
+			// a truncated packet must not be mistaken for a complete one
+			if got, err := c.decodeText(s[:len(s)/2]); err == nil && bytes.Equal(got, frame) {
+				t.Errorf("session %s, frame %s: truncated text decoded to the complete frame", session.name, e.name)
+			}
+		}
+	}
+}
+
+func TestExtractPackets(t *testing.T) {
+	b, e := transport.PacketBegin, transport.PacketEnd
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"empty", "", nil},
+		{"single", b + "abc" + e, []string{"abc"}},
+		{"multiple", b + "abc" + e + "\n" + b + "def" + e, []string{"abc", "def"}},
+		{"wrapped", "prompt$ " + b + "ab\r\n c\td" + e + " trailing", []string{"abcd"}},
+		{"lost end", b + "abc" + b + "def" + e, []string{"def"}},
+		{"truncated", b + "abc" + e + b + "de", []string{"abc"}},
+		{"legacy", "abc\ndef\n", []string{"abc", "def"}},
+	}
+	for _, tt := range tests {
+		got := extractPackets(tt.content)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	s := encodeUnicode(bytes.Repeat([]byte("cliptun"), 50))
+	for _, width := range []int{0, 1, 7, 76, 1000} {
+		wrapped := wrapText(s, width)
+		if width > 0 {
+			for _, line := range strings.Split(wrapped, "\n") {
+				line = strings.TrimPrefix(strings.TrimSuffix(line, transport.PacketEnd), transport.PacketBegin)
+				if n := len([]rune(line)); n > width {
+					t.Errorf("width %d: line of %d characters", width, n)
+				}
+			}
+		}
+		got := extractPackets(wrapped)
+		if len(got) != 1 || got[0] != s {
+			t.Errorf("width %d: got %q, want %q", width, got, s)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// With forward error correction enabled, the packets sent form groups,
+// which are followed by parity packets computed using a Reed-Solomon
+// erasure code. The receiver can reconstruct as many lost packets of a
+// group as parity packets arrived, without waiting for the resync timeout.
+// The size of the groups is given by the redundancy ratio, so there is one
+// parity packet per group (e.g. 5 packets per group with a ratio of 0.2).
+// On stream transports, a group is complete once it has that many packets,
+// once the send window is full (so no more packets can be added until the
+// peer acknowledged some), or once half the resync timeout has passed
+// since its first packet was sent. The parity packets are sent right away.
+//
+// The clipboard only holds the packets written last, so a group spans
+// several rounds there, and its parity packets are sent along with the
+// next packet written, so a single lost write never takes a packet and the
+// parity covering it. If the peer acknowledged the whole group by then, the
+// parity is not needed and dropped, so there is no overhead as long as no
+// packets get lost. To let the peer make use of the parity, the send window
+// spans a group on the clipboard: once the acknowledgement of the packet
+// written last is overdue, the next packet is written instead of waiting
+// for the resync timeout (replacing the packet, which is either on its way
+// or lost, in which case it can be reconstructed). If there is no packet
+// to write, the group is completed early and its parity written along
+// with the packet written last. In broadcast mode, the groups span
+// consecutive writes (see broadcast.go).
+//
+// Parity packets are not part of the sequence of packets (like probes), so
+// peers not supporting them simply ignore them. Their payload contains:
+//
+//	first    varint   sequence number of the first packet of the group
+//	count    1 byte   number of packets in the group
+//	index    1 byte   index of the parity packet
+//	lengths  uvarint per packet of the group, the length of its shard
+//	parity   the parity shard
+//
+// The shard of a packet is its flags byte followed by its frame body
+// (leaving out the acknowledgements, which change if the packet is
+// retransmitted), padded with zeros to the length of the longest shard of
+// the group. Parity shard i is the sum of the shards j multiplied by
+// 1/(x_i + y_j) (with x_i = count+i and y_j = j) over GF(2^8). As every
+// square submatrix of this Cauchy matrix is invertible, any count shards
+// of a group suffice to reconstruct the others.
+
+const (
+	// the largest group sent, receivers keep at least this many packets
+	// after delivering them, as the parity for them may still follow
+	fecMaxGroup = 16
+	fecMaxRatio = 1
+)
+
+type fecState struct {
+	ratio float64
+	// the number of packets per group, and whether groups span several
+	// rounds on the clipboard
+	size      int
+	clipboard bool
+	// packets of the current group, and when its first packet was sent
+	group        []CBPacket
+	groupStarted time.Time
+	// clipboard only: the last group completed, its parity packets are
+	// sent along with the next packet written
+	complete []CBPacket
+
+	// packets received that may be part of a group still missing packets,
+	// the parity packets of those groups (by their first sequence number),
+	// and the size of the largest group seen
+	received map[int]CBPacket
+	groups   map[int]*fecGroup
+	maxGroup int
+}
+
+type fecGroup struct {
+	lengths []int
+	parity  map[int][]byte
+}
+
+type parityPacket struct {
+	first   int
+	index   int
+	lengths []int
+	parity  []byte
+}
+
+func encodeParity(p parityPacket) []byte {
+	var buf []byte
+	var tmp [binary.MaxVarintLen64]byte
+	buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(p.first))]...)
+	buf = append(buf, byte(len(p.lengths)), byte(p.index))
+	for _, length := range p.lengths {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(length))]...)
+	}
+	return append(buf, p.parity...)
+}
+
+func decodeParity(buf []byte) (parityPacket, error) {
+	var p parityPacket
+	r := bytes.NewReader(buf)
+	first, err := binary.ReadVarint(r)
+	if err != nil {
+		return p, fmt.Errorf("cannot read first sequence number: %s", err)
+	}
+	count, err := r.ReadByte()
+	if err != nil || count == 0 {
+		return p, fmt.Errorf("cannot read group size")
+	}
+	index, err := r.ReadByte()
+	if err != nil || int(count)+int(index) > 256 {
+		return p, fmt.Errorf("cannot read index")
+	}
+	p.first, p.index = int(first), int(index)
+	for i := 0; i < int(count); i++ {
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length == 0 || length > uint64(len(buf)) {
+			return p, fmt.Errorf("cannot read shard lengths")
+		}
+		p.lengths = append(p.lengths, int(length))
+	}
+	p.parity = buf[len(buf)-r.Len():]
+	for _, length := range p.lengths {
+		if length > len(p.parity) {
+			return p, fmt.Errorf("parity shard is truncated")
+		}
+	}
+	return p, nil
+}
+
+// fecShard returns the shard of a packet.
+func fecShard(p CBPacket) []byte {
+	p.Ack, p.SAck = -1, nil
+	var flags byte
+	if p.More {
+		flags |= flagMore
+	}
+	if p.Streamed {
+		flags |= flagStreamed
+	}
+	return append([]byte{flags}, encodeFrame(p)...)
+}
+
+func decodeShard(shard []byte) (CBPacket, error) {
+	p, err := decodeFrame(shard[1:])
+	if err != nil {
+		return CBPacket{}, err
+	}
+	p.More = shard[0]&flagMore != 0
+	p.Streamed = shard[0]&flagStreamed != 0
+	return p, nil
+}
+
+// fecGroupSize returns the number of packets per group for a redundancy
+// ratio, so that a group is followed by one parity packet.
+func fecGroupSize(ratio float64) int {
+	if ratio <= 0 {
+		return 0
+	}
+	// tolerate rounding errors, e.g. 5 packets for 0.2
+	size := int(1/ratio + 1e-9)
+	if size < 1 {
+		size = 1
+	}
+	if size > fecMaxGroup {
+		size = fecMaxGroup
+	}
+	return size
+}
+
+// addToGroup adds a packet sent for the first time to the current group.
+func (c *Channel) addToGroup(p CBPacket) {
+	if c.fec.ratio <= 0 {
+		return
+	}
+	if len(c.fec.group) == 0 {
+		c.fec.groupStarted = time.Now()
+	}
+	c.fec.group = append(c.fec.group, p)
+	if len(c.fec.group) >= c.fec.size {
+		c.closeGroup()
+	}
+}
+
+// closeGroup completes the current group. Its parity packets are sent
+// right away on stream transports, and along with the next packet written
+// on the clipboard.
+func (c *Channel) closeGroup() {
+	if !c.fec.clipboard {
+		c.sendParity()
+		return
+	}
+	c.appendParity()
+	c.fec.complete = c.fec.group
+	c.fec.group = nil
+}
+
+// checkParity completes the current group early if no more packets can
+// be added in time, and sends its parity packets. On the clipboard, this
+// happens once the acknowledgement of the packet written last is overdue.
+func (c *Channel) checkParity(windowFull bool, lastSendTime time.Time, lastAckReceived int) {
+	if !c.fec.clipboard {
+		if len(c.fec.group) > 0 && (windowFull || time.Now().Sub(c.fec.groupStarted) >= c.resyncTimeout()/2) {
+			c.sendParity()
+		}
+		return
+	}
+	if time.Now().Sub(lastSendTime) < c.resyncTimeout()/2 {
+		return
+	}
+	if n := len(c.fec.group); n > 0 && c.fec.group[n-1].Seq > lastAckReceived {
+		c.closeGroup()
+	}
+	c.appendParity()
+}
+
+// fecAcknowledged drops the last group completed once the peer
+// acknowledged all of its packets, as its parity is not needed anymore.
+func (c *Channel) fecAcknowledged(lastAckReceived int) {
+	if n := len(c.fec.complete); n > 0 && c.fec.complete[n-1].Seq <= lastAckReceived {
+		c.fec.complete = nil
+	}
+}
+
+// sendParity sends the parity packets for the current group, which is
+// started over.
+func (c *Channel) sendParity() {
+	group := c.fec.group
+	c.fec.group = nil
+	for _, p := range c.parityPackets(group) {
+		encoded, err := c.packet2string(p)
+		if err != nil {
+			c.errorLogger.Println("cannot send parity packet:", err)
+			return
+		}
+		c.writeText(encoded)
+	}
+}
+
+// appendParity writes the parity packets for the last group completed
+// along with the packets written last (clipboard only).
+func (c *Channel) appendParity() {
+	group := c.fec.complete
+	c.fec.complete = nil
+	for _, p := range c.parityPackets(group) {
+		encoded, err := c.packet2string(p)
+		if err != nil {
+			c.errorLogger.Println("cannot send parity packet:", err)
+			return
+		}
+		c.appendText(encoded)
+	}
+}
+
+// parityPackets returns the parity packets for a group.
+func (c *Channel) parityPackets(group []CBPacket) []CBPacket {
+	if len(group) == 0 {
+		return nil
+	}
+	k := len(group)
+	// tolerate rounding errors, e.g. a single parity packet for 5 packets
+	// and a ratio of 0.2
+	m := int(math.Ceil(float64(k)*c.fec.ratio - 1e-9))
+	if m < 1 {
+		m = 1
+	}
+	shards := make([][]byte, k)
+	lengths := make([]int, k)
+	size := 0
+	for j, p := range group {
+		shards[j] = fecShard(p)
+		lengths[j] = len(shards[j])
+		if lengths[j] > size {
+			size = lengths[j]
+		}
+	}
+	var packets []CBPacket
+	for i := 0; i < m; i++ {
+		parity := make([]byte, size)
+		for j, shard := range shards {
+			gfMulAdd(parity, shard, cauchy(k, i, j))
+		}
+		payload := encodeParity(parityPacket{first: group[0].Seq, index: i, lengths: lengths, parity: parity})
+		packets = append(packets, CBPacket{Target: c.peerHeader, Session: c.session, Type: PacketTypeParity,
+			Seq: -1, Ack: -1, Payload: string(payload)})
+	}
+	return packets
+}
+
+// processParityPacket keeps a parity packet received until the packets of
+// its group have been received or reconstructed.
+func (c *Channel) processParityPacket(packet CBPacket, lastRecvIndex int) {
+	p, err := decodeParity([]byte(packet.Payload))
+	if err != nil {
+		c.debugLogger.Println("received malformed parity packet:", err)
+		return
+	}
+	k := len(p.lengths)
+	if p.first+k-1 <= lastRecvIndex {
+		return
+	}
+	if k > c.fec.maxGroup {
+		c.fec.maxGroup = k
+	}
+	if c.fec.groups == nil {
+		c.fec.groups = make(map[int]*fecGroup)
+	}
+	g, ok := c.fec.groups[p.first]
+	if !ok || len(g.lengths) != k {
+		g = &fecGroup{lengths: p.lengths, parity: make(map[int][]byte)}
+		c.fec.groups[p.first] = g
+	}
+	g.parity[p.index] = p.parity
+}
+
+// fecReceived keeps a packet received, as it may be needed to reconstruct
+// another packet of its group.
+func (c *Channel) fecReceived(packet CBPacket) {
+	if c.fec.received == nil {
+		c.fec.received = make(map[int]CBPacket)
+	}
+	c.fec.received[packet.Seq] = packet
+}
+
+// recoverPackets reconstructs the packets missing from groups for which
+// enough packets and parity packets have been received, and adds them to
+// the receive queue.
+func (c *Channel) recoverPackets(lastRecvIndex int) {
+	keep := c.fec.maxGroup
+	if keep < fecMaxGroup {
+		keep = fecMaxGroup
+	}
+	for seq := range c.fec.received {
+		if seq <= lastRecvIndex-keep {
+			delete(c.fec.received, seq)
+		}
+	}
+	for first, g := range c.fec.groups {
+		k := len(g.lengths)
+		var missing []int
+		for seq := first; seq < first+k; seq++ {
+			if _, ok := c.fec.received[seq]; !ok && seq > lastRecvIndex {
+				missing = append(missing, seq)
+			}
+		}
+		if len(missing) == 0 {
+			delete(c.fec.groups, first)
+			continue
+		}
+		recovered, ok := c.reconstruct(first, g)
+		if !ok {
+			continue
+		}
+		delete(c.fec.groups, first)
+		for _, seq := range missing {
+			p, err := decodeShard(recovered[seq-first][:g.lengths[seq-first]])
+			if err != nil || p.Seq != seq || p.Session != c.session || p.Target != c.ownHeader {
+				c.debugLogger.Println("cannot reconstruct packet", seq)
+				continue
+			}
+			c.debugLogger.Println("reconstructed packet", seq)
+			c.updateStats(func(s *Stats) { s.Recovered++ })
+			c.receiveQueue[seq] = p
+			c.fecReceived(p)
+		}
+	}
+}
+
+// reconstruct returns the shards of all packets of a group, or false if not
+// enough packets and parity packets have been received.
+func (c *Channel) reconstruct(first int, g *fecGroup) ([][]byte, bool) {
+	k := len(g.lengths)
+	size := 0
+	for _, length := range g.lengths {
+		if length > size {
+			size = length
+		}
+	}
+	// the rows of the encoding matrix of the shards available, and the
+	// shards themselves
+	var rows [][]byte
+	var inputs [][]byte
+	for j := 0; j < k && len(rows) < k; j++ {
+		p, ok := c.fec.received[first+j]
+		if !ok {
+			continue
+		}
+		shard := fecShard(p)
+		if len(shard) != g.lengths[j] {
+			// not the packet the parity was computed for
+			return nil, false
+		}
+		row := make([]byte, k)
+		row[j] = 1
+		rows = append(rows, row)
+		inputs = append(inputs, append(shard, make([]byte, size-len(shard))...))
+	}
+	for i, parity := range g.parity {
+		if len(rows) == k {
+			break
+		}
+		if len(parity) != size {
+			continue
+		}
+		row := make([]byte, k)
+		for j := range row {
+			row[j] = cauchy(k, i, j)
+		}
+		rows = append(rows, row)
+		inputs = append(inputs, parity)
+	}
+	if len(rows) < k {
+		return nil, false
+	}
+	inverse, ok := gfInvert(rows)
+	if !ok {
+		return nil, false
+	}
+	shards := make([][]byte, k)
+	for j := range shards {
+		shards[j] = make([]byte, size)
+		for r, input := range inputs {
+			gfMulAdd(shards[j], input, inverse[j][r])
+		}
+	}
+	return shards, true
+}
+
+// resetFEC drops the state of forward error correction for a new session.
+func (c *Channel) resetFEC() {
+	c.fec.group = nil
+	c.fec.groupStarted = time.Time{}
+	c.fec.complete = nil
+	c.fec.received = nil
+	c.fec.groups = nil
+	c.fec.maxGroup = 0
+}
+
+// Arithmetic in GF(2^8), using the polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = gfTables()
+
+func gfTables() ([512]byte, [256]byte) {
+	var exp [512]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds src multiplied by factor to dst.
+func gfMulAdd(dst, src []byte, factor byte) {
+	if factor == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(b, factor)
+	}
+}
+
+// cauchy returns the coefficient of shard j for parity shard i of a group
+// of k shards.
+func cauchy(k, i, j int) byte {
+	return gfInv(byte(k+i) ^ byte(j))
+}
+
+// gfInvert inverts a square matrix using Gauss-Jordan elimination.
+func gfInvert(m [][]byte) ([][]byte, bool) {
+	n := len(m)
+	a := make([][]byte, n)
+	inv := make([][]byte, n)
+	for i := range m {
+		a[i] = append([]byte(nil), m[i]...)
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+		factor := gfInv(a[col][col])
+		for j := 0; j < n; j++ {
+			a[col][j] = gfMul(a[col][j], factor)
+			inv[col][j] = gfMul(inv[col][j], factor)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || a[row][col] == 0 {
+				continue
+			}
+			factor := a[row][col]
+			gfMulAdd(a[row], a[col], factor)
+			gfMulAdd(inv[row], inv[col], factor)
+		}
+	}
+	return inv, true
+}
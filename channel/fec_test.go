@@ -0,0 +1,327 @@
+package channel
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParityRoundtrip(t *testing.T) {
+	tests := []parityPacket{
+		{first: 0, index: 0, lengths: []int{1}, parity: []byte{7}},
+		{first: -3, index: 2, lengths: []int{10, 300, 5}, parity: make([]byte, 300)},
+		{first: 1 << 40, index: 127, lengths: []int{1, 1, 1}, parity: []byte{1}},
+	}
+	for _, p := range tests {
+		got, err := decodeParity(encodeParity(p))
+		if err != nil {
+			t.Errorf("%+v: %s", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("got %+v, want %+v", got, p)
+		}
+	}
+}
+
+func TestParityInvalid(t *testing.T) {
+	valid := encodeParity(parityPacket{first: 5, index: 1, lengths: []int{3, 4}, parity: []byte{1, 2, 3, 4}})
+	for n := 0; n < len(valid); n++ {
+		if _, err := decodeParity(valid[:n]); err == nil {
+			t.Errorf("parity packet truncated to %d bytes decoded without error", n)
+		}
+	}
+	tests := []struct {
+		name string
+		p    parityPacket
+	}{
+		{"empty group", parityPacket{first: 5, index: 0, parity: []byte{1}}},
+		{"index out of range", parityPacket{first: 5, index: 255, lengths: []int{1, 1}, parity: []byte{1}}},
+		{"zero length", parityPacket{first: 5, index: 0, lengths: []int{0, 1}, parity: []byte{1}}},
+		{"shard longer than parity", parityPacket{first: 5, index: 0, lengths: []int{2, 3}, parity: []byte{1, 2}}},
+	}
+	for _, tt := range tests {
+		if _, err := decodeParity(encodeParity(tt.p)); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
+
+func TestGFInvert(t *testing.T) {
+	for k := 1; k <= 8; k++ {
+		m := make([][]byte, k)
+		for i := range m {
+			m[i] = make([]byte, k)
+			for j := range m[i] {
+				m[i][j] = cauchy(k, i, j)
+			}
+		}
+		inv, ok := gfInvert(m)
+		if !ok {
+			t.Fatalf("cauchy matrix of size %d is not invertible", k)
+		}
+		for i := 0; i < k; i++ {
+			for j := 0; j < k; j++ {
+				var sum byte
+				for l := 0; l < k; l++ {
+					sum ^= gfMul(m[i][l], inv[l][j])
+				}
+				want := byte(0)
+				if i == j {
+					want = 1
+				}
+				if sum != want {
+					t.Fatalf("size %d: product has %d at %d,%d", k, sum, i, j)
+				}
+			}
+		}
+	}
+	if _, ok := gfInvert([][]byte{{1, 2}, {1, 2}}); ok {
+		t.Error("singular matrix inverted")
+	}
+}
+
+// fecGroupPackets returns a group of k data packets of different sizes.
+func fecGroupPackets(c *Channel, first, k int) []CBPacket {
+	var packets []CBPacket
+	for i := 0; i < k; i++ {
+		packets = append(packets, CBPacket{Target: c.peerHeader, Session: c.session, Seq: first + i, Ack: 3, SAck: []int{first + k + 1},
+			Payload: strings.Repeat(fmt.Sprint(i), 10+i*7), More: i%2 == 0, Streamed: i == 1})
+	}
+	return packets
+}
+
+func TestFECRecovery(t *testing.T) {
+	tests := []struct {
+		name string
+		k    int
+		// ratio of parity packets, and which packets and parity packets
+		// get lost
+		ratio       float64
+		lost        []int
+		lostParity  []int
+		recoverable bool
+	}{
+		{"nothing lost", 4, 0.25, nil, nil, true},
+		{"single packet", 1, 0.1, []int{0}, nil, true},
+		{"one lost", 4, 0.25, []int{2}, nil, true},
+		{"first and last lost", 8, 0.5, []int{0, 7}, []int{1, 3}, true},
+		{"as many lost as parity", 6, 0.5, []int{1, 3, 5}, nil, true},
+		{"all lost", 3, 1, []int{0, 1, 2}, nil, true},
+		{"parity lost", 4, 0.25, []int{1}, []int{0}, false},
+		{"too many lost", 6, 0.5, []int{0, 1, 2, 3}, nil, false},
+		{"too much parity lost", 6, 0.5, []int{0, 1}, []int{0, 2}, false},
+	}
+	for _, tt := range tests {
+		sender, receiver := testChannel(SERVER, ""), testChannel(CLIENT, "")
+		sender.fec.ratio = tt.ratio
+		receiver.receiveQueue = make(map[int]CBPacket)
+		receiver.debugLogger = newLevelLogger(nil, LevelDebug)
+		const first = 10
+		packets := fecGroupPackets(sender, first, tt.k)
+		parity := sender.parityPackets(packets)
+		if want := int(math.Ceil(float64(tt.k) * tt.ratio)); len(parity) != want {
+			t.Errorf("%s: got %d parity packets, want %d", tt.name, len(parity), want)
+		}
+
+		lost := make(map[int]bool)
+		for _, i := range tt.lost {
+			lost[i] = true
+		}
+		for i, p := range packets {
+			if !lost[i] {
+				receiver.receiveQueue[p.Seq] = p
+				receiver.fecReceived(p)
+			}
+		}
+		lostParity := make(map[int]bool)
+		for _, i := range tt.lostParity {
+			lostParity[i] = true
+		}
+		for i, p := range parity {
+			if !lostParity[i] {
+				receiver.processParityPacket(p, first-1)
+			}
+		}
+		receiver.recoverPackets(first - 1)
+
+		recovered := 0
+		for _, i := range tt.lost {
+			got, ok := receiver.receiveQueue[first+i]
+			if !ok {
+				if tt.recoverable {
+					t.Errorf("%s: packet %d not recovered", tt.name, i)
+				}
+				continue
+			}
+			if !tt.recoverable {
+				t.Errorf("%s: packet %d recovered without enough parity", tt.name, i)
+			}
+			recovered++
+			// the acknowledgements are not part of the shard
+			want := packets[i]
+			want.Ack, want.SAck = -1, nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: packet %d: got %+v, want %+v", tt.name, i, got, want)
+			}
+		}
+		if got := receiver.Stats().Recovered; got != int64(recovered) {
+			t.Errorf("%s: %d packets recovered, stats show %d", tt.name, recovered, got)
+		}
+		if tt.recoverable && len(receiver.fec.groups) != 0 {
+			t.Errorf("%s: group not dropped after recovery", tt.name)
+		}
+	}
+}
+
+func TestFECCorrupted(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(packets, parity []CBPacket)
+	}{
+		{"other packet received", func(packets, parity []CBPacket) {
+			packets[0].Payload += "x"
+		}},
+		{"truncated parity", func(packets, parity []CBPacket) {
+			parity[0].Payload = parity[0].Payload[:len(parity[0].Payload)-1]
+		}},
+		{"malformed parity", func(packets, parity []CBPacket) {
+			parity[0].Payload = "\x02"
+		}},
+		{"other session", func(packets, parity []CBPacket) {
+			for i := range packets {
+				packets[i].Session++
+			}
+		}},
+	}
+	for _, tt := range tests {
+		sender, receiver := testChannel(SERVER, ""), testChannel(CLIENT, "")
+		sender.fec.ratio = 0.5
+		receiver.receiveQueue = make(map[int]CBPacket)
+		receiver.debugLogger = newLevelLogger(nil, LevelDebug)
+		packets := fecGroupPackets(sender, 0, 4)
+		parity := sender.parityPackets(packets)
+		tt.corrupt(packets, parity)
+		// the last packet is lost, and one parity packet would suffice to
+		// recover it
+		for _, p := range packets[:3] {
+			receiver.fecReceived(p)
+		}
+		receiver.processParityPacket(parity[0], -1)
+		receiver.recoverPackets(-1)
+		if p, ok := receiver.receiveQueue[3]; ok {
+			t.Errorf("%s: recovered %+v", tt.name, p)
+		}
+	}
+}
+
+// memClipboard keeps the text written last, like the clipboard, and all
+// texts written.
+type memClipboard struct {
+	text   string
+	writes []string
+}
+
+func (m *memClipboard) Read() (string, error) { return m.text, nil }
+func (m *memClipboard) Write(text string) error {
+	m.text = text
+	m.writes = append(m.writes, text)
+	return nil
+}
+func (m *memClipboard) Reset() { m.text = "" }
+
+func TestFECClipboard(t *testing.T) {
+	clip := &memClipboard{}
+	sender, receiver := testChannel(CLIENT, ""), testChannel(SERVER, "")
+	sender.transport = clip
+	sender.interval = time.Second
+	sender.fec.ratio = 0.25
+	sender.fec.size = fecGroupSize(sender.fec.ratio)
+	sender.fec.clipboard = true
+	receiver.receiveQueue = make(map[int]CBPacket)
+	receiver.debugLogger = newLevelLogger(nil, LevelDebug)
+	if sender.fec.size != 4 {
+		t.Fatalf("got groups of %d packets, want 4", sender.fec.size)
+	}
+
+	// write sends a packet like the clipboard loop, and returns the
+	// parity packets written along with it
+	packets := fecGroupPackets(sender, 0, 12)
+	write := func(p CBPacket) []CBPacket {
+		encoded, err := sender.packet2string(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.writeText(encoded)
+		sender.appendParity()
+		sender.addToGroup(p)
+		return parityWritten(t, receiver, clip)
+	}
+
+	// the parity of the first group follows with the first packet of the
+	// next one, and suffices to recover a packet of the group lost
+	for i, p := range packets[:4] {
+		if parity := write(p); len(parity) != 0 {
+			t.Errorf("packet %d: %d parity packets written before the group is complete", i, len(parity))
+		}
+		if i != 2 {
+			receiver.receiveQueue[p.Seq] = p
+			receiver.fecReceived(p)
+		}
+	}
+	parity := write(packets[4])
+	if len(parity) != 1 {
+		t.Fatalf("got %d parity packets along with the next group, want 1", len(parity))
+	}
+	receiver.processParityPacket(parity[0], -1)
+	receiver.recoverPackets(-1)
+	if _, ok := receiver.receiveQueue[2]; !ok {
+		t.Error("lost packet not recovered")
+	}
+
+	// the parity is dropped once the whole group has been acknowledged
+	for _, p := range packets[5:8] {
+		write(p)
+	}
+	sender.fecAcknowledged(7)
+	if parity := write(packets[8]); len(parity) != 0 {
+		t.Errorf("got %d parity packets for an acknowledged group", len(parity))
+	}
+
+	// once the acknowledgement is overdue, the partial group is completed
+	// and its parity written along with the packets written last
+	sender.checkParity(false, time.Now(), 7)
+	if parity := parityWritten(t, receiver, clip); len(parity) != 0 {
+		t.Errorf("got %d parity packets before the acknowledgement is overdue", len(parity))
+	}
+	sender.checkParity(false, time.Now().Add(-time.Minute), 8)
+	if parity := parityWritten(t, receiver, clip); len(parity) != 0 {
+		t.Errorf("got %d parity packets for an acknowledged partial group", len(parity))
+	}
+	sender.checkParity(false, time.Now().Add(-time.Minute), 7)
+	parity = parityWritten(t, receiver, clip)
+	if len(parity) != 1 {
+		t.Fatalf("got %d parity packets for an overdue partial group, want 1", len(parity))
+	}
+	if n := len(extractPackets(clip.text)); n != 2 {
+		t.Errorf("parity does not follow the packet written last: %q", clip.text)
+	}
+}
+
+// parityWritten returns the parity packets on the clipboard.
+func parityWritten(t *testing.T, receiver *Channel, clip *memClipboard) []CBPacket {
+	var parity []CBPacket
+	for _, data := range extractPackets(clip.text) {
+		p, err := receiver.string2packet(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Type == PacketTypeParity {
+			parity = append(parity, p)
+		}
+	}
+	return parity
+}
@@ -0,0 +1,150 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// Packets are written to the transport as frames, encoded as text using the
+// encoding agreed on during the handshake (see encoding.go):
+//
+//	magic    2 bytes  "CT"
+//	version  1 byte   frameVersion
+//	flags    1 byte   see below
+//	address  4 bytes  only if flagAddressed is set, see medium.go
+//	nonce    24 bytes
+//	sealed   secretbox(header || body), the body compressed using the
+//	         codec given in the flags
+//
+// The header (magic, version, flags and address) is sent in the clear, so
+// a peer can tell an incompatible version apart from a packet it cannot
+// decrypt (and skip packets of other pairs without decrypting them), and
+// is repeated inside the sealed part to detect tampering. The body
+// contains the packet itself:
+//
+//	target   1 byte
+//	type     1 byte
+//	session  8 bytes, big endian
+//	seq      varint
+//	ack      varint
+//	sacks    uvarint count, followed by a varint per sequence number
+//	payload  uvarint length, followed by the payload
+//
+// A peer receiving a frame with an unknown version answers with a frame
+// flagged as flagVersionNak, which only consists of the header (carrying
+// its own version) and the target, so both sides can report the mismatch.
+// As the NAK is not authenticated, it only stops the channel as long as no
+// packet of the peer could be authenticated (see reportVersionMismatch).
+
+const (
+	frameMagic      = "CT"
+	frameVersion    = 1
+	frameHeaderSize = 4
+	addressSize     = 4
+
+	// the header contains the address of the pair
+	flagAddressed = 1 << 0
+	// the peer does not support the version of a received frame
+	flagVersionNak = 1 << 1
+	// the payload is part of the compression stream
+	flagStreamed = 1 << 2
+	// the payload is continued in the next packet
+	flagMore = 1 << 3
+	// the upper 4 bits contain the ID of the codec used to compress the
+	// body (0 if not compressed)
+	flagCodecShift = 4
+)
+
+// versionError is returned for frames that cannot be decoded because the
+// peer uses an incompatible version.
+type versionError struct {
+	version byte
+	// legacy is set for packets of versions preceding the frame format
+	legacy bool
+	// nak is set if the peer rejected our version
+	nak bool
+}
+
+func (e *versionError) Error() string {
+	switch {
+	case e.legacy:
+		return "incompatible version: the peer uses an older version of cliptun, please use the same version on both sides"
+	case e.nak:
+		return fmt.Sprintf("incompatible version: the peer only supports wire format version %d, but version %d is used here, please use the same version of cliptun on both sides", e.version, frameVersion)
+	default:
+		return fmt.Sprintf("incompatible version: the peer uses wire format version %d, but only version %d is supported here, please use the same version of cliptun on both sides", e.version, frameVersion)
+	}
+}
+
+// frameHeader returns the header of a frame, including the address of the
+// pair if it has a name.
+func (c *Channel) frameHeader(flags byte) []byte {
+	if c.address != nil {
+		flags |= flagAddressed
+	}
+	return append(append([]byte(frameMagic), frameVersion, flags), c.address...)
+}
+
+// encodeFrame encodes the body of a packet.
+func encodeFrame(p CBPacket) []byte {
+	buf := make([]byte, 0, 32+len(p.Payload))
+	var tmp [binary.MaxVarintLen64]byte
+	putVarint := func(v int) {
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(v))]...)
+	}
+	putUvarint := func(v int) {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(v))]...)
+	}
+
+	buf = append(buf, byte(p.Target), byte(p.Type))
+	binary.BigEndian.PutUint64(tmp[:8], p.Session)
+	buf = append(buf, tmp[:8]...)
+	putVarint(p.Seq)
+	putVarint(p.Ack)
+	putUvarint(len(p.SAck))
+	for _, seq := range p.SAck {
+		putVarint(seq)
+	}
+	putUvarint(len(p.Payload))
+	return append(buf, p.Payload...)
+}
+
+// decodeFrame decodes the body of a packet.
+func decodeFrame(buf []byte) (CBPacket, error) {
+	if len(buf) < 10 {
+		return CBPacket{}, fmt.Errorf("truncated packet")
+	}
+	var p CBPacket
+	p.Target = PeerType(buf[0])
+	p.Type = CBPacketType(buf[1])
+	p.Session = binary.BigEndian.Uint64(buf[2:10])
+	r := bytes.NewReader(buf[10:])
+
+	seq, err := binary.ReadVarint(r)
+	if err != nil {
+		return CBPacket{}, fmt.Errorf("cannot read sequence number: %s", err)
+	}
+	ack, err := binary.ReadVarint(r)
+	if err != nil {
+		return CBPacket{}, fmt.Errorf("cannot read ack: %s", err)
+	}
+	p.Seq, p.Ack = int(seq), int(ack)
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return CBPacket{}, fmt.Errorf("cannot read selective acks")
+	}
+	for i := uint64(0); i < n; i++ {
+		seq, err := binary.ReadVarint(r)
+		if err != nil {
+			return CBPacket{}, fmt.Errorf("cannot read selective acks: %s", err)
+		}
+		p.SAck = append(p.SAck, int(seq))
+	}
+	n, err = binary.ReadUvarint(r)
+	if err != nil || n != uint64(r.Len()) {
+		return CBPacket{}, fmt.Errorf("bad payload length")
+	}
+	p.Payload = string(buf[len(buf)-r.Len():])
+	return p, nil
+}
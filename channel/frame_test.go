@@ -0,0 +1,172 @@
+package channel
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testChannel returns a channel with an established session, as far as
+// needed to encode and decode packets.
+func testChannel(typ PeerType, name string) *Channel {
+	c := &Channel{ownHeader: typ, peerHeader: SERVER, session: 0x0123456789abcdef}
+	if typ == SERVER {
+		c.peerHeader = CLIENT
+	}
+	if name != "" {
+		c.address = pairAddress(name)
+	}
+	c.encoding = encodingByName(defaultEncoding)
+	c.codec = codecByName(defaultCodec)
+	c.sendKey = [32]byte{1, 2, 3}
+	c.recvKey = c.sendKey
+	c.handshake.established = true
+	return c
+}
+
+func TestFrameRoundtrip(t *testing.T) {
+	tests := []struct {
+		name string
+		p    CBPacket
+	}{
+		{"empty", CBPacket{Target: SERVER, Seq: 0, Ack: -1}},
+		{"data", CBPacket{Target: CLIENT, Session: 42, Seq: 7, Ack: 5, Payload: "hello"}},
+		{"sacks", CBPacket{Target: SERVER, Type: PacketTypeControl, Seq: 100, Ack: 90, SAck: []int{92, 95, 99}, Payload: "FIN"}},
+		{"negative", CBPacket{Target: SERVER, Type: PacketTypeParity, Seq: -1, Ack: -1, Payload: "\x00\xff"}},
+		{"large", CBPacket{Target: CLIENT, Session: 1<<64 - 1, Seq: 1 << 40, Ack: 1<<40 - 1, Payload: strings.Repeat("x", 70000)}},
+	}
+	for _, tt := range tests {
+		got, err := decodeFrame(encodeFrame(tt.p))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.p) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.p)
+		}
+	}
+}
+
+func TestDecodeFrameInvalid(t *testing.T) {
+	frame := encodeFrame(CBPacket{Target: SERVER, Seq: 3, Ack: 2, SAck: []int{4}, Payload: "payload"})
+	for n := 0; n < len(frame); n++ {
+		if _, err := decodeFrame(frame[:n]); err == nil {
+			t.Errorf("frame truncated to %d bytes decoded without error", n)
+		}
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"trailing data", append(append([]byte(nil), frame...), 0)},
+		{"huge sack count", append(append([]byte(nil), frame[:12]...), 0xff, 0xff, 0xff, 0xff, 0x0f)},
+		{"bad varint", append(append([]byte(nil), frame[:10]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)},
+	}
+	for _, tt := range tests {
+		if _, err := decodeFrame(tt.frame); err == nil {
+			t.Errorf("%s: decoded without error", tt.name)
+		}
+	}
+}
+
+func TestPacketRoundtrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		pair     string
+		encoding string
+		codec    string
+		p        CBPacket
+	}{
+		{"plain", "", "base64", "none", CBPacket{Target: CLIENT, Seq: 1, Ack: 0, Payload: "data"}},
+		{"compressed", "", "base64", "zlib", CBPacket{Target: CLIENT, Seq: 2, Ack: 1, Payload: strings.Repeat("abc", 500)}},
+		{"fragment", "", "base85", "brotli", CBPacket{Target: CLIENT, Seq: 3, Ack: 1, Payload: strings.Repeat("abc", 500), More: true}},
+		{"streamed", "", "unicode", "zlib", CBPacket{Target: CLIENT, Seq: 4, Ack: 1, Payload: "already compressed", Streamed: true}},
+		{"addressed", "vm1", "base32", "zstd", CBPacket{Target: CLIENT, Seq: 5, Ack: 4, SAck: []int{6}, Payload: strings.Repeat("abc", 500)}},
+		{"handshake", "vm2", "base64url", "lz4", CBPacket{Target: CLIENT, Type: PacketTypeHandshake, Seq: -1, Ack: -1, Payload: "HELLO"}},
+	}
+	for _, tt := range tests {
+		sender, receiver := testChannel(SERVER, tt.pair), testChannel(CLIENT, tt.pair)
+		sender.encoding, receiver.encoding = encodingByName(tt.encoding), encodingByName(tt.encoding)
+		sender.codec = codecByName(tt.codec)
+		tt.p.Session = sender.session
+		s, err := sender.packet2string(tt.p)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		got, err := receiver.string2packet(s)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.p) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.p)
+		}
+	}
+}
+
+func TestPacketInvalid(t *testing.T) {
+	sender := testChannel(SERVER, "")
+	frame := func(header []byte) string {
+		return sender.encodeText(header, false)
+	}
+	valid, err := sender.packet2string(CBPacket{Target: CLIENT, Seq: 1, Payload: "data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := sender.decodeText(valid)
+	tampered := append([]byte(nil), buf...)
+	tampered[3] |= flagMore
+	corrupted := append([]byte(nil), buf...)
+	corrupted[len(corrupted)-1] ^= 1
+	other := testChannel(SERVER, "")
+	other.sendKey = [32]byte{9}
+	otherKey, _ := other.packet2string(CBPacket{Target: CLIENT, Seq: 1, Payload: "data"})
+	named := testChannel(SERVER, "vm1")
+	addressed, _ := named.packet2string(CBPacket{Target: CLIENT, Seq: 1, Payload: "data"})
+	otherPair := testChannel(SERVER, "vm2")
+	otherAddressed, _ := otherPair.packet2string(CBPacket{Target: CLIENT, Seq: 1, Payload: "data"})
+
+	tests := []struct {
+		name     string
+		pair     string
+		s        string
+		foreign  bool
+		version  *versionError
+		contains string
+	}{
+		{"garbage", "", "not a packet!", false, nil, "encoding"},
+		{"bad magic", "", frame([]byte("XX\x01\x00")), false, nil, "format"},
+		{"truncated header", "", frame(buf[:frameHeaderSize+10]), false, nil, "truncated"},
+		{"truncated", "", frame(buf[:len(buf)-5]), false, nil, "decrypt"},
+		{"tampered header", "", frame(tampered), false, nil, "modified"},
+		{"corrupted", "", frame(corrupted), false, nil, "decrypt"},
+		{"other key", "", otherKey, false, nil, "decrypt"},
+		{"newer version", "", frame([]byte{'C', 'T', frameVersion + 1, 0}), false, &versionError{version: frameVersion + 1}, ""},
+		{"version nak", "", frame([]byte{'C', 'T', frameVersion + 1, flagVersionNak, byte(CLIENT)}), false, &versionError{version: frameVersion + 1, nak: true}, ""},
+		{"version nak for peer", "", frame([]byte{'C', 'T', frameVersion + 1, flagVersionNak, byte(SERVER)}), false, nil, "nak"},
+		{"version nak of own version", "", frame([]byte{'C', 'T', frameVersion, flagVersionNak, byte(CLIENT)}), false, nil, "nak"},
+		{"addressed, not named", "", addressed, true, nil, ""},
+		{"not addressed, named", "vm1", valid, true, nil, ""},
+		{"other pair", "vm1", otherAddressed, true, nil, ""},
+		{"truncated address", "vm1", frame([]byte{'C', 'T', frameVersion, flagAddressed, 1, 2}), false, nil, "truncated"},
+	}
+	for _, tt := range tests {
+		receiver := testChannel(CLIENT, tt.pair)
+		_, err := receiver.string2packet(tt.s)
+		switch {
+		case err == nil:
+			t.Errorf("%s: decoded without error", tt.name)
+		case tt.foreign:
+			if err != errForeignPacket {
+				t.Errorf("%s: got %q, want a foreign packet", tt.name, err)
+			}
+		case tt.version != nil:
+			if verr, ok := err.(*versionError); !ok || *verr != *tt.version {
+				t.Errorf("%s: got %q, want %q", tt.name, err, tt.version)
+			}
+		case !strings.Contains(err.Error(), tt.contains):
+			t.Errorf("%s: got %q, want an error containing %q", tt.name, err, tt.contains)
+		}
+	}
+}
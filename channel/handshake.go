@@ -0,0 +1,488 @@
+package channel
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Before any data is exchanged, the client and the server agree on a
+// session: the client sends a HELLO containing a random nonce and an
+// ephemeral X25519 public key, the server answers with a HELLO-ACK
+// containing the client's nonce, its own nonce and its own ephemeral
+// public key. Both packets carry a MAC using the key derived from the
+// password (or loaded from a key file), so only peers knowing the password
+// can complete the handshake. The HELLO also names the key derivation
+// function used, a server using a different one (or failing to verify the
+// MAC) answers with a HELLO-NAK so both sides can report the reason. As
+// the HELLO-NAK cannot be authenticated, the client only logs it and keeps
+// trying, until the peer timeout (if any) expires (see keepalive.go).
+//
+// The session key and the session ID are derived from the shared X25519
+// secret and both nonces, so packets left over from a previous run (or
+// from another session) are rejected. As the ephemeral
+// private keys are discarded right after deriving the session key (and the
+// session key on shutdown), recorded sessions cannot be decrypted later
+// even if the password becomes known (forward secrecy).
+//
+// The client keeps resending its HELLO until the HELLO-ACK arrives, and
+// confirms the session by sending the first data packet. Until then the
+// server answers every HELLO, switching to a new session if the nonce
+// changed (e.g. when it picked up a stale HELLO at startup). If the
+// handshake does not complete after several attempts, both sides suggest
+// broadcast mode (see broadcast.go), as the link may only work in one
+// direction.
+//
+// In pairing mode the password is not trusted to authenticate the peer.
+// Instead, both sides display a short code derived from the session key,
+// which the operators compare. To keep an attacker in the middle from
+// trying out keys until the codes match, the client's HELLO only contains
+// a commitment to its public key, which is revealed in a REVEAL packet
+// after the server sent its own public key. The client then sends a
+// CONFIRM (answered by a CONFIRM-ACK) once its operator accepted the code,
+// and the server answers it only after its operator did the same. Both
+// packets contain a MAC proving the knowledge of the session key. If a
+// code is rejected, an ABORT is sent to the peer.
+
+const (
+	nonceSize = 32
+	keySize   = 32
+)
+
+// handshakeKey seals handshake packets, which are authenticated by their
+// MAC instead. Using a well-known key allows reporting a mismatching key
+// derivation function instead of silently ignoring the peer.
+var handshakeKey = sha256.Sum256([]byte("cliptun handshake"))
+
+type handshakeState struct {
+	clientNonce []byte
+	serverNonce []byte
+	// own ephemeral key pair, the private key is wiped once the session
+	// key has been derived
+	privateKey [keySize]byte
+	publicKey  [keySize]byte
+	// the server's answer to the client's current HELLO
+	reply CBPacket
+	// the client's current request, resent until it is answered
+	request  CBPacket
+	lastSent time.Time
+
+	// the nonce of the last HELLO rejected, to report errors only once, and
+	// the reason given by the peer (client only)
+	rejectedNonce []byte
+	rejected      error
+	// the number of HELLOs (or answers) sent without a sign of the peer
+	// receiving them, see suggestBroadcast
+	unanswered int
+
+	// pairing mode only
+	commitment    []byte
+	revealed      bool
+	code          string
+	pairingResult chan bool
+	accepted      bool
+
+	established bool
+	confirmed   bool
+}
+
+func randomNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("cannot get random bytes for nonce: %s", err)
+	}
+	return nonce, nil
+}
+
+// Connected returns a channel that is closed as soon as the handshake with
+// the peer is completed.
+func (c *Channel) Connected() <-chan struct{} {
+	return c.connected
+}
+
+// wipe overwrites key material that is no longer needed.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// generateKeyPair creates a new ephemeral key pair for the handshake.
+func (hs *handshakeState) generateKeyPair() error {
+	if _, err := io.ReadFull(rand.Reader, hs.privateKey[:]); err != nil {
+		return fmt.Errorf("cannot generate ephemeral key: %s", err)
+	}
+	curve25519.ScalarBaseMult(&hs.publicKey, &hs.privateKey)
+	return nil
+}
+
+func commitment(publicKey []byte) []byte {
+	h := sha256.Sum256(append([]byte("cliptun commitment"), publicKey...))
+	return h[:]
+}
+
+// confirmationMAC proves the knowledge of the session key to the peer.
+func (c *Channel) confirmationMAC(sender PeerType) []byte {
+	mac := hmac.New(sha256.New, c.sendKey[:])
+	fmt.Fprintf(mac, "cliptun confirm %d", sender)
+	return mac.Sum(nil)
+}
+
+// handshakeMAC authenticates a handshake packet using the key derived from
+// the password.
+func (c *Channel) handshakeMAC(msg []byte) []byte {
+	mac := hmac.New(sha256.New, c.masterKey[:])
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// handshakePacket creates a handshake packet, consisting of the command,
+// its arguments and a MAC.
+func (c *Channel) handshakePacket(cmd string, args ...[]byte) CBPacket {
+	msg := []byte(cmd + ":")
+	for _, arg := range args {
+		msg = append(msg, arg...)
+	}
+	return CBPacket{Target: c.peerHeader, Type: PacketTypeHandshake, Payload: string(append(msg, c.handshakeMAC(msg)...))}
+}
+
+// deriveSessionKey derives the session key, the session ID and the pairing
+// code from the shared secret of the own private and the peer's public
+// key, the key derived from the password and the nonces of both peers.
+// The own ephemeral private key is wiped afterwards.
+func (c *Channel) deriveSessionKey(clientNonce, serverNonce, peerPublicKey []byte) error {
+	var peerKey, shared [keySize]byte
+	copy(peerKey[:], peerPublicKey)
+	curve25519.ScalarMult(&shared, &c.handshake.privateKey, &peerKey)
+	wipe(c.handshake.privateKey[:])
+	defer wipe(shared[:])
+	if shared == [keySize]byte{} {
+		return fmt.Errorf("invalid public key received from peer")
+	}
+
+	// the compression streams start over with the new session
+	c.sendStream, c.recvStream = nil, nil
+
+	secret := append(shared[:], c.masterKey[:]...)
+	defer wipe(secret)
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte("cliptun session"))
+	if _, err := io.ReadFull(kdf, c.sendKey[:]); err != nil {
+		return fmt.Errorf("cannot derive session key: %s", err)
+	}
+	c.recvKey = c.sendKey
+	c.nextRecvKey = nextKey(&c.recvKey)
+	var id [8]byte
+	if _, err := io.ReadFull(kdf, id[:]); err != nil {
+		return fmt.Errorf("cannot derive session id: %s", err)
+	}
+	c.session = binary.BigEndian.Uint64(id[:])
+	var code [4]byte
+	if _, err := io.ReadFull(kdf, code[:]); err != nil {
+		return fmt.Errorf("cannot derive pairing code: %s", err)
+	}
+	n := binary.BigEndian.Uint32(code[:]) % 1000000
+	c.handshake.code = fmt.Sprintf("%03d-%03d", n/1000, n%1000)
+	return nil
+}
+
+// startPairing asks the operator to compare the pairing code.
+func (c *Channel) startPairing() {
+	hs := &c.handshake
+	hs.pairingResult = make(chan bool, 1)
+	c.debugLogger.Println("asking operator to confirm pairing code")
+	go func(code string) {
+		hs.pairingResult <- c.pairingCallback(code)
+	}(hs.code)
+}
+
+// checkPairing returns true once the operator accepted the pairing code.
+func (c *Channel) checkPairing() bool {
+	hs := &c.handshake
+	if hs.accepted || hs.pairingResult == nil {
+		return hs.accepted
+	}
+	select {
+	case ok := <-hs.pairingResult:
+		if !ok {
+			c.writePacket(c.handshakePacket("ABORT"))
+			c.stop(fmt.Errorf("pairing code rejected"))
+			return false
+		}
+		hs.accepted = true
+	default:
+	}
+	return hs.accepted
+}
+
+// sendHandshake sends the client's current request if the session has not
+// been established yet and the last one was not answered in time. It is
+// called by both peers to check whether the operator has confirmed the
+// pairing code.
+func (c *Channel) sendHandshake() {
+	hs := &c.handshake
+	if hs.confirmed {
+		return
+	}
+	accepted := c.checkPairing()
+	if c.ownHeader == SERVER {
+		return
+	}
+	if hs.revealed && hs.request.Payload == "" && accepted {
+		hs.request = c.handshakePacket("CONFIRM", c.confirmationMAC(CLIENT))
+		hs.lastSent = time.Time{}
+	}
+	if hs.request.Payload == "" && !hs.established {
+		nonce, err := randomNonce()
+		if err == nil {
+			err = hs.generateKeyPair()
+		}
+		if err != nil {
+			c.errorLogger.Println("cannot start handshake:", err)
+			return
+		}
+		hs.clientNonce = nonce
+		key := hs.publicKey[:]
+		if c.pairing {
+			key = commitment(key)
+		}
+		encoding := c.configuredEncoding
+		if encoding == "" {
+			encoding = defaultEncoding
+		}
+		hs.request = c.handshakePacket("HELLO", shortString(c.kdf), shortString(supportedCodecs()),
+			shortString(supportedEncodings()), shortString(encoding), nonce, key)
+		hs.lastSent = time.Time{}
+	}
+	if hs.request.Payload == "" || time.Now().Sub(hs.lastSent) < c.resyncTimeout() {
+		return
+	}
+	if !hs.lastSent.IsZero() {
+		c.debugLogger.Println("no answer from peer, resending handshake...")
+		if !hs.established {
+			c.suggestBroadcast("no answer from peer")
+		}
+	}
+	hs.lastSent = time.Now()
+	c.writePacket(hs.request)
+}
+
+func (c *Channel) processHandshakePacket(packet CBPacket) {
+	hs := &c.handshake
+	payload := []byte(packet.Payload)
+	i := bytes.IndexByte(payload, ':')
+	if i < 0 || len(payload) < i+1+sha256.Size {
+		c.debugLogger.Println("received malformed handshake packet")
+		return
+	}
+	msg, mac := payload[:len(payload)-sha256.Size], payload[len(payload)-sha256.Size:]
+	cmd, arg := string(payload[:i]), msg[i+1:]
+	authenticated := hmac.Equal(mac, c.handshakeMAC(msg))
+	c.debugLogger.Println("received handshake packet:", cmd)
+	if authenticated {
+		// the peer is there, even if the handshake takes a while (e.g.
+		// until the operators compared the pairing code)
+		c.peerAlive()
+	}
+
+	switch {
+	case cmd == "HELLO" && c.ownHeader == SERVER:
+		peerKDF, arg, ok := readShortString(arg)
+		peerCodecs, arg, ok2 := readShortString(arg)
+		peerEncodings, arg, ok3 := readShortString(arg)
+		proposedEncoding, arg, ok4 := readShortString(arg)
+		if !ok || !ok2 || !ok3 || !ok4 || len(arg) != nonceSize+keySize {
+			c.debugLogger.Println("received malformed HELLO")
+			return
+		}
+		if hs.confirmed || c.pairing && hs.established {
+			c.debugLogger.Println("ignoring handshake, session already established")
+			return
+		}
+		clientNonce, clientKey := arg[:nonceSize], arg[nonceSize:]
+		if peerKDF != c.kdf || !authenticated {
+			c.rejectHello(clientNonce, peerKDF)
+			return
+		}
+		if !bytes.Equal(clientNonce, hs.clientNonce) {
+			serverNonce, err := randomNonce()
+			if err == nil {
+				err = hs.generateKeyPair()
+			}
+			if err == nil && !c.pairing {
+				err = c.deriveSessionKey(clientNonce, serverNonce, clientKey)
+			}
+			if err != nil {
+				c.errorLogger.Println("cannot answer handshake:", err)
+				return
+			}
+			hs.clientNonce, hs.serverNonce = clientNonce, serverNonce
+			if c.pairing {
+				// the client's public key follows in the REVEAL
+				hs.commitment = clientKey
+			} else {
+				hs.established = true
+				c.debugLogger.Printf("new session %016x, waiting for client to confirm\n", c.session)
+			}
+			c.selectCodec(peerCodecs)
+			encoding := c.selectEncoding(proposedEncoding, peerEncodings)
+			c.useEncoding(encoding)
+			hs.reply = c.handshakePacket("HELLO-ACK", hs.clientNonce, hs.serverNonce, hs.publicKey[:],
+				shortString(encoding), []byte(supportedCodecs()))
+		} else {
+			// the client did not receive our answer
+			c.suggestBroadcast("peer does not receive the handshake answers")
+		}
+		c.writePacket(hs.reply)
+
+	case cmd == "HELLO-NAK" && c.ownHeader == CLIENT:
+		if hs.established || len(arg) < nonceSize || !bytes.Equal(arg[:nonceSize], hs.clientNonce) {
+			return
+		}
+		// anyone can send a HELLO-NAK, so it does not end the handshake
+		hs.rejected = fmt.Errorf("handshake rejected by peer: authentication failed, check the password or key")
+		if peerKDF := string(arg[nonceSize:]); peerKDF != c.kdf {
+			hs.rejected = fmt.Errorf("handshake rejected by peer: the peer derives its key using %s, but %s is used here", peerKDF, c.kdf)
+		}
+		if !bytes.Equal(hs.clientNonce, hs.rejectedNonce) {
+			hs.rejectedNonce = hs.clientNonce
+			c.errorLogger.Println(hs.rejected)
+		}
+
+	case !authenticated:
+		c.debugLogger.Println("ignoring handshake packet with invalid MAC")
+
+	case cmd == "HELLO-ACK" && c.ownHeader == CLIENT:
+		if hs.established {
+			return
+		}
+		if len(arg) < 2*nonceSize+keySize || !bytes.Equal(arg[:nonceSize], hs.clientNonce) {
+			c.debugLogger.Println("ignoring handshake answer for another session")
+			return
+		}
+		hs.serverNonce = arg[nonceSize : 2*nonceSize]
+		serverKey := arg[2*nonceSize : 2*nonceSize+keySize]
+		encoding, peerCodecs, ok := readShortString(arg[2*nonceSize+keySize:])
+		if !ok {
+			c.debugLogger.Println("received malformed HELLO-ACK")
+			return
+		}
+		if err := c.deriveSessionKey(hs.clientNonce, hs.serverNonce, serverKey); err != nil {
+			c.errorLogger.Println("cannot complete handshake:", err)
+			// the private key is gone, start over with a new HELLO
+			hs.request = CBPacket{}
+			return
+		}
+		hs.established = true
+		c.selectCodec(string(peerCodecs))
+		c.useEncoding(encoding)
+		if !c.pairing {
+			c.sessionConfirmed()
+			return
+		}
+		c.startPairing()
+		hs.request = c.handshakePacket("REVEAL", hs.clientNonce, hs.publicKey[:])
+		hs.lastSent = time.Time{}
+
+	case cmd == "REVEAL" && c.ownHeader == SERVER && c.pairing:
+		if len(arg) != nonceSize+keySize || !bytes.Equal(arg[:nonceSize], hs.clientNonce) {
+			c.debugLogger.Println("ignoring handshake packet for another session")
+			return
+		}
+		if !hs.established {
+			clientKey := arg[nonceSize:]
+			if !bytes.Equal(commitment(clientKey), hs.commitment) {
+				c.errorLogger.Println("public key of client does not match its commitment")
+				return
+			}
+			if err := c.deriveSessionKey(hs.clientNonce, hs.serverNonce, clientKey); err != nil {
+				c.errorLogger.Println("cannot answer handshake:", err)
+				return
+			}
+			hs.established = true
+			c.debugLogger.Printf("new session %016x, waiting for pairing code confirmation\n", c.session)
+			c.startPairing()
+		}
+		c.writePacket(c.handshakePacket("REVEAL-ACK", hs.clientNonce))
+
+	case cmd == "REVEAL-ACK" && c.ownHeader == CLIENT && c.pairing:
+		if !hs.established || hs.revealed || !bytes.Equal(arg, hs.clientNonce) {
+			return
+		}
+		hs.revealed = true
+		hs.request = CBPacket{}
+
+	case cmd == "CONFIRM" && c.ownHeader == SERVER && c.pairing:
+		if !hs.established || !hmac.Equal(arg, c.confirmationMAC(CLIENT)) {
+			c.debugLogger.Println("ignoring confirmation for another session")
+			return
+		}
+		if !c.checkPairing() {
+			// the client sends its confirmation again until we answer it
+			return
+		}
+		c.writePacket(c.handshakePacket("CONFIRM-ACK", c.confirmationMAC(SERVER)))
+
+	case cmd == "CONFIRM-ACK" && c.ownHeader == CLIENT && c.pairing:
+		if hs.confirmed || !hs.established || !hmac.Equal(arg, c.confirmationMAC(SERVER)) {
+			return
+		}
+		c.sessionConfirmed()
+
+	case cmd == "ABORT" && c.pairing:
+		c.stop(fmt.Errorf("pairing code rejected by peer"))
+
+	default:
+		c.debugLogger.Println("received unexpected handshake packet:", cmd)
+	}
+}
+
+// shortString prefixes a string with its length, for handshake packets.
+func shortString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// readShortString reads a string prefixed by its length (as a single byte)
+// from a handshake packet.
+func readShortString(arg []byte) (string, []byte, bool) {
+	if len(arg) < 1 || len(arg) < 1+int(arg[0]) {
+		return "", arg, false
+	}
+	return string(arg[1 : 1+arg[0]]), arg[1+arg[0]:], true
+}
+
+// rejectHello tells the client why its HELLO was rejected. The client
+// cannot verify the MAC of this packet, it only serves to show a helpful
+// error message.
+func (c *Channel) rejectHello(clientNonce []byte, peerKDF string) {
+	hs := &c.handshake
+	if !bytes.Equal(clientNonce, hs.rejectedNonce) {
+		hs.rejectedNonce = clientNonce
+		if peerKDF != c.kdf {
+			c.errorLogger.Printf("handshake failed: the peer derives its key using %s, but %s is used here\n", peerKDF, c.kdf)
+		} else {
+			c.errorLogger.Println("handshake failed: authentication failed, check the password or key")
+		}
+	}
+	c.writePacket(c.handshakePacket("HELLO-NAK", clientNonce, []byte(c.kdf)))
+}
+
+// sessionConfirmed is called once the peer is known to use the current
+// session.
+func (c *Channel) sessionConfirmed() {
+	c.handshake.confirmed = true
+	c.debugLogger.Printf("peer connected (session %016x)\n", c.session)
+	c.statsConnected()
+	close(c.connected)
+	if c.ownHeader == CLIENT {
+		c.startProbing()
+	}
+}
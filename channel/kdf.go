@@ -0,0 +1,99 @@
+package channel
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// KDF describes how the key used to authenticate the handshake is derived
+// from the password. It is written as the name of the function, optionally
+// followed by its parameters, e.g. "argon2id:t=3,m=65536,p=4":
+//
+//	pbkdf2    i: iterations (PBKDF2-SHA256)
+//	argon2id  t: iterations, m: memory in KiB, p: threads
+//	scrypt    n: CPU/memory cost, r: block size, p: parallelization
+//
+// Parameters not given use the defaults below. A key loaded from a key file
+// is described as "key".
+type KDF struct {
+	Function string
+	Params   map[string]int
+}
+
+var kdfDefaults = map[string]map[string]int{
+	"pbkdf2":   {"i": 4096},
+	"argon2id": {"t": 3, "m": 64 * 1024, "p": 4},
+	"scrypt":   {"n": 32768, "r": 8, "p": 1},
+}
+
+// ParseKDF parses the description of a key derivation function.
+func ParseKDF(spec string) (KDF, error) {
+	args := strings.SplitN(spec, ":", 2)
+	defaults, ok := kdfDefaults[args[0]]
+	if !ok {
+		return KDF{}, fmt.Errorf("unknown key derivation function '%s'", args[0])
+	}
+	kdf := KDF{Function: args[0], Params: make(map[string]int)}
+	for name, value := range defaults {
+		kdf.Params[name] = value
+	}
+	if len(args) == 1 || args[1] == "" {
+		return kdf, nil
+	}
+	for _, param := range strings.Split(args[1], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return KDF{}, fmt.Errorf("bad key derivation parameter '%s'", param)
+		}
+		if _, ok := defaults[kv[0]]; !ok {
+			return KDF{}, fmt.Errorf("unknown parameter '%s' for %s", kv[0], kdf.Function)
+		}
+		value, err := strconv.Atoi(kv[1])
+		if err != nil || value <= 0 {
+			return KDF{}, fmt.Errorf("bad value for key derivation parameter '%s'", kv[0])
+		}
+		kdf.Params[kv[0]] = value
+	}
+	return kdf, nil
+}
+
+// String returns the canonical description of the key derivation, which
+// must be identical on both sides.
+func (k KDF) String() string {
+	var params []string
+	for _, name := range []string{"i", "t", "m", "n", "r", "p"} {
+		if value, ok := k.Params[name]; ok {
+			params = append(params, fmt.Sprintf("%s=%d", name, value))
+		}
+	}
+	if len(params) == 0 {
+		return k.Function
+	}
+	return k.Function + ":" + strings.Join(params, ",")
+}
+
+// DeriveKey derives a 32 byte key from the password.
+func (k KDF) DeriveKey(password string) ([]byte, error) {
+	// use a static salt as we need the same hash on both sides of the tunnel,
+	// every session then uses its own key derived during the handshake
+	salt := []byte{'c', 'l', 'i', 'p', 't', 'u', 'n', 0}
+	p := k.Params
+	switch k.Function {
+	case "pbkdf2":
+		return pbkdf2.Key([]byte(password), salt, p["i"], 32, sha256.New), nil
+	case "argon2id":
+		if p["p"] > 255 {
+			return nil, fmt.Errorf("argon2id supports at most 255 threads")
+		}
+		return argon2.IDKey([]byte(password), salt, uint32(p["t"]), uint32(p["m"]), uint8(p["p"]), 32), nil
+	case "scrypt":
+		return scrypt.Key([]byte(password), salt, p["n"], p["r"], p["p"], 32)
+	}
+	return nil, fmt.Errorf("cannot derive key using %s", k.Function)
+}
@@ -0,0 +1,102 @@
+package channel
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseKDF(t *testing.T) {
+	tests := []struct {
+		spec string
+		// the canonical description, empty if the spec is invalid
+		want string
+	}{
+		{"pbkdf2", "pbkdf2:i=4096"},
+		{"pbkdf2:", "pbkdf2:i=4096"},
+		{"pbkdf2:i=100000", "pbkdf2:i=100000"},
+		{"argon2id", "argon2id:t=3,m=65536,p=4"},
+		{"argon2id:p=1,t=1", "argon2id:t=1,m=65536,p=1"},
+		{"scrypt:r=16", "scrypt:n=32768,r=16,p=1"},
+		{"", ""},
+		{"md5", ""},
+		{"PBKDF2", ""},
+		{"pbkdf2:i", ""},
+		{"pbkdf2:t=3", ""},
+		{"pbkdf2:i=0", ""},
+		{"pbkdf2:i=-1", ""},
+		{"pbkdf2:i=1k", ""},
+		{"scrypt:n=1024,", ""},
+		{"argon2id:t=1;m=64", ""},
+	}
+	for _, tt := range tests {
+		kdf, err := ParseKDF(tt.spec)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%q: parsed as %s", tt.spec, kdf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.spec, err)
+			continue
+		}
+		if got := kdf.String(); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.spec, got, tt.want)
+		}
+		// both sides compare the canonical description
+		again, err := ParseKDF(kdf.String())
+		if err != nil || !reflect.DeepEqual(again, kdf) {
+			t.Errorf("%q: %s parsed as %+v, %v", tt.spec, kdf, again, err)
+		}
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// known answers computed using independent implementations (Python's
+	// hashlib, and a reference implementation of Argon2id checked against
+	// RFC 9106), with the static salt "cliptun\x00"
+	tests := []struct {
+		spec     string
+		password string
+		want     string
+	}{
+		{"pbkdf2", "correct horse", "341c4f03c275282f9c84e842461cb5cd1fea5ecd655ca35a6034488062bd38e5"},
+		{"pbkdf2:i=1", "correct horse", "a58fe327dce878ba2810079d75e7497c7dcb6df0f6aea9873653110cabf68db6"},
+		{"argon2id:t=1,m=64,p=1", "correct horse", "faa39d93e525066535b3c760f7e4e2e45921fadf5dee5ea7376c0f82eda35a68"},
+		{"argon2id:t=2,m=256,p=4", "correct horse", "e055c8cef7c56aa1e8ac8713500ed52a0bee8ca9569117d1da6bee9f81856c16"},
+		{"scrypt:n=1024", "correct horse", "88630e6c42494843c40b139cf875082110ea9a988f757df8e2df0214fb9e3128"},
+		{"scrypt:n=16,r=1,p=2", "correct horse", "7624be45f6b1ce14b1738463c11ce8b41347268a62141d2ffaf56e488222d3ad"},
+	}
+	for _, tt := range tests {
+		kdf, err := ParseKDF(tt.spec)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.spec, err)
+		}
+		key, err := kdf.DeriveKey(tt.password)
+		if err != nil {
+			t.Errorf("%s: %s", tt.spec, err)
+			continue
+		}
+		if got := hex.EncodeToString(key); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.spec, got, tt.want)
+		}
+		other, err := kdf.DeriveKey(tt.password + " ")
+		if err != nil || hex.EncodeToString(other) == tt.want {
+			t.Errorf("%s: same key for another password", tt.spec)
+		}
+	}
+}
+
+func TestDeriveKeyInvalid(t *testing.T) {
+	tests := []KDF{
+		{Function: "argon2id", Params: map[string]int{"t": 1, "m": 64, "p": 256}},
+		{Function: "scrypt", Params: map[string]int{"n": 1000, "r": 8, "p": 1}},
+		{Function: "key"},
+	}
+	for _, kdf := range tests {
+		if key, err := kdf.DeriveKey("correct horse"); err == nil {
+			t.Errorf("%s: derived %x", kdf, key)
+		}
+	}
+}
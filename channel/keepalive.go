@@ -0,0 +1,77 @@
+package channel
+
+import (
+	"fmt"
+	"time"
+)
+
+// PeerState describes whether the peer is still responding.
+type PeerState int
+
+const (
+	// PeerAlive is reported once the peer responds again after being
+	// reported as dead.
+	PeerAlive PeerState = iota
+	// PeerDead is reported if no packet has been received from the peer
+	// within the peer timeout.
+	PeerDead
+)
+
+// PeerStateCallback is called whenever the state of the peer changes.
+// Without a callback, the channel stops with an error once the peer timed
+// out.
+type PeerStateCallback func(state PeerState)
+
+type keepaliveState struct {
+	lastRecv time.Time
+	lastSent time.Time
+	dead     bool
+}
+
+// peerAlive is called for every packet received from the peer.
+func (c *Channel) peerAlive() {
+	k := &c.keepalive
+	k.lastRecv = time.Now()
+	if k.dead {
+		k.dead = false
+		c.notifyPeerState(PeerAlive)
+	}
+}
+
+// checkKeepalive sends a KEEPALIVE control packet if nothing has been sent
+// for a while, so the peer knows we are still there.
+func (c *Channel) checkKeepalive() {
+	k := &c.keepalive
+	if now := time.Now(); c.keepaliveInterval > 0 && now.Sub(k.lastSent) >= c.keepaliveInterval {
+		k.lastSent = now
+		go c.sendControl("KEEPALIVE")
+	}
+}
+
+// checkPeerTimeout checks whether the peer timed out. The timeout starts
+// with the channel, so a peer that never shows up, or stops responding
+// during the handshake or while the session is resumed, is detected as
+// well.
+func (c *Channel) checkPeerTimeout() {
+	k := &c.keepalive
+	if c.peerTimeout > 0 && !k.dead && time.Now().Sub(k.lastRecv) > c.peerTimeout {
+		k.dead = true
+		c.notifyPeerState(PeerDead)
+	}
+}
+
+func (c *Channel) notifyPeerState(state PeerState) {
+	if c.peerStateCallback != nil {
+		go c.peerStateCallback(state)
+		return
+	}
+	if state != PeerDead {
+		return
+	}
+	if hs := &c.handshake; hs.rejected != nil && !hs.established {
+		// the peer kept rejecting the handshake
+		c.stop(hs.rejected)
+		return
+	}
+	c.stop(fmt.Errorf("peer did not respond for %s, giving up", c.peerTimeout))
+}
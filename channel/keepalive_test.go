@@ -0,0 +1,70 @@
+package channel
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerTimeout(t *testing.T) {
+	rejected := fmt.Errorf("handshake rejected by peer")
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		silent      time.Duration
+		established bool
+		rejected    error
+		callback    bool
+		// the error the channel stops with, empty if it keeps running
+		err string
+	}{
+		{"no timeout", 0, time.Hour, true, nil, false, ""},
+		{"peer alive", time.Minute, time.Second, true, nil, false, ""},
+		{"peer dead", time.Minute, 2 * time.Minute, true, nil, false, "did not respond"},
+		{"peer never showed up", time.Minute, 2 * time.Minute, false, nil, false, "did not respond"},
+		{"handshake rejected", time.Minute, 2 * time.Minute, false, rejected, false, rejected.Error()},
+		{"rejected before", time.Minute, 2 * time.Minute, true, rejected, false, "did not respond"},
+		{"callback", time.Minute, 2 * time.Minute, true, nil, true, ""},
+	}
+	for _, tt := range tests {
+		c := testChannel(CLIENT, "")
+		c.stopping = make(chan struct{})
+		c.peerTimeout = tt.timeout
+		c.keepalive.lastRecv = time.Now().Add(-tt.silent)
+		c.handshake.established = tt.established
+		c.handshake.rejected = tt.rejected
+		states := make(chan PeerState, 1)
+		if tt.callback {
+			c.peerStateCallback = func(state PeerState) { states <- state }
+		}
+		c.checkPeerTimeout()
+
+		select {
+		case <-c.stopping:
+			if tt.err == "" {
+				t.Errorf("%s: channel stopped: %v", tt.name, c.err)
+			} else if c.err == nil || !strings.Contains(c.err.Error(), tt.err) {
+				t.Errorf("%s: got %v, want an error containing %q", tt.name, c.err, tt.err)
+			}
+		default:
+			if tt.err != "" {
+				t.Errorf("%s: channel not stopped", tt.name)
+			}
+		}
+		if tt.callback {
+			select {
+			case state := <-states:
+				if state != PeerDead {
+					t.Errorf("%s: got state %d, want PeerDead", tt.name, state)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("%s: callback not called", tt.name)
+			}
+			c.peerAlive()
+			if state := <-states; state != PeerAlive {
+				t.Errorf("%s: got state %d, want PeerAlive", tt.name, state)
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package channel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+)
+
+// LogLevel is the level of a message logged by a channel.
+type LogLevel int
+
+const (
+	// LevelError is used for problems the user should know about.
+	LevelError LogLevel = iota
+	// LevelDebug is used for changes of the state of the channel.
+	LevelDebug
+	// LevelTrace is used for every packet sent and received.
+	LevelTrace
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	default:
+		return fmt.Sprintf("level %d", int(l))
+	}
+}
+
+// Logger receives the messages of a channel or tunnel, each channel uses
+// its own. Log may be called from several goroutines at once, the message
+// does not end with a newline.
+type Logger interface {
+	Log(level LogLevel, msg string)
+}
+
+// NewLogger returns a Logger writing the messages up to the given level to
+// w, preceded by the prefix and the level ("Error: ", "DEBUG: " or
+// "TRACE: ").
+func NewLogger(w io.Writer, prefix string, level LogLevel) Logger {
+	return &writerLogger{w: w, prefix: prefix, level: level}
+}
+
+var levelPrefixes = map[LogLevel]string{
+	LevelError: "Error: ",
+	LevelDebug: "DEBUG: ",
+	LevelTrace: "TRACE: ",
+}
+
+type writerLogger struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	prefix string
+	level  LogLevel
+}
+
+func (l *writerLogger) Log(level LogLevel, msg string) {
+	if level > l.level {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintf(l.w, "%s%s%s\n", l.prefix, levelPrefixes[level], msg)
+}
+
+// levelWriter passes the lines written by a log.Logger to a Logger.
+type levelWriter struct {
+	logger Logger
+	level  LogLevel
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	w.logger.Log(w.level, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// newLevelLogger returns a log.Logger passing its messages to the Logger
+// using the given level.
+func newLevelLogger(logger Logger, level LogLevel) *log.Logger {
+	if logger == nil {
+		return log.New(ioutil.Discard, "", 0)
+	}
+	if l, ok := logger.(*writerLogger); ok && level > l.level {
+		// do not even format messages that are dropped anyway
+		return log.New(ioutil.Discard, "", 0)
+	}
+	return log.New(levelWriter{logger, level}, "", 0)
+}
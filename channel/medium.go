@@ -0,0 +1,82 @@
+package channel
+
+import (
+	"crypto/sha256"
+	"errors"
+	mrand "math/rand"
+	"time"
+)
+
+// Several pairs of peers can share a transport (e.g. a host sharing its
+// clipboard with several virtual machines), if each server is given a
+// name, which the client uses to select it. The frames of a named pair
+// carry an address derived from the name in their header (see frame.go),
+// so packets of other pairs are skipped without decrypting them. Pairs
+// without a name use frames without an address, and skip those of named
+// pairs as well.
+//
+// As the clipboard only holds the last content written, the pairs must
+// not overwrite each other's packets before they have been read. Once
+// packets of another pair have been seen, the transport is considered
+// shared: new packets of other pairs are left in place for at least an
+// interval (the time their receiver takes to read them), plus a random
+// delay so the waiting pairs do not all write at once. To keep a busy
+// pair from locking out the others, no more than mediumMaxDefer rounds
+// are skipped in a row. The transport is not cleared on a resync or on
+// shutdown anymore, as that would destroy the packets of other pairs.
+
+// number of rounds in a row sending is deferred at most
+const mediumMaxDefer = 3
+
+// errForeignPacket is returned by string2packet for packets of other pairs.
+var errForeignPacket = errors.New("packet of another pair")
+
+type mediumState struct {
+	// packets of other pairs have been seen on the transport
+	shared bool
+	// the content holding packets of other pairs read last, until when to
+	// leave it in place, and the number of rounds deferred in a row
+	foreign   string
+	busyUntil time.Time
+	deferred  int
+}
+
+// pairAddress derives the address used in the frames of a named pair.
+func pairAddress(name string) []byte {
+	h := sha256.Sum256([]byte("cliptun address:" + name))
+	return h[:addressSize]
+}
+
+// senseMedium is called with the content read from the transport, foreign
+// is set if it contains packets of other pairs.
+func (c *Channel) senseMedium(content string, foreign bool) {
+	m := &c.medium
+	if !foreign {
+		m.foreign = ""
+		m.busyUntil = time.Time{}
+		return
+	}
+	if !m.shared {
+		m.shared = true
+		c.debugLogger.Println("transport is shared with other pairs")
+	}
+	if content == m.foreign {
+		return
+	}
+	interval := c.Interval()
+	m.foreign = content
+	m.busyUntil = time.Now().Add(interval + time.Duration(mrand.Int63n(int64(interval)+1)))
+}
+
+// mediumBusy returns whether to defer sending, as another pair just wrote
+// to the transport.
+func (c *Channel) mediumBusy() bool {
+	m := &c.medium
+	if !time.Now().Before(m.busyUntil) || m.deferred >= mediumMaxDefer {
+		m.deferred = 0
+		return false
+	}
+	m.deferred++
+	c.traceLogger.Println("transport in use by another pair, deferring")
+	return true
+}
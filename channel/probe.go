@@ -0,0 +1,185 @@
+package channel
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Some clipboard chains silently truncate large content. To find the
+// largest blocksize that gets through, the client sends PROBE packets of
+// increasing size before sending any data, which the server answers with
+// a PROBE-ACK. Probe packets are not part of the sequence of packets, a
+// probe that is not answered in time (twice) is considered lost. Starting
+// at the minimum blocksize, the size is doubled until a probe is lost or
+// the maximum is reached, followed by a binary search between the largest
+// size received and the smallest size lost. The result is sent to the
+// server in a BLOCKSIZE control packet.
+//
+// If a number of packets in a row cannot be decoded during the session,
+// the client probes again. The server asks the client to do so by sending
+// a REPROBE control packet.
+
+const (
+	// number of times a probe is sent before it is considered lost
+	probeAttempts = 2
+	// the binary search stops once the sizes differ by less than 1/probePrecision
+	probePrecision = 8
+	// number of packets in a row that cannot be decoded before probing again
+	probeFailureThreshold = 4
+)
+
+type probeState struct {
+	// the bounds for the blocksize
+	min, max int
+	active   bool
+	// the largest size received and the smallest size lost so far
+	received, lost int
+	size           int
+	id             int
+	attempts       int
+	lastSent       time.Time
+	// packets in a row that could not be decoded
+	failures int
+}
+
+// startProbing starts searching for the largest blocksize. Only the client
+// sends probes.
+func (c *Channel) startProbing() {
+	p := &c.probe
+	if !c.probeEnabled || p.active {
+		return
+	}
+	if c.ownHeader != CLIENT {
+		go c.sendControl("REPROBE")
+		return
+	}
+	c.debugLogger.Printf("probing blocksize (%s - %s)\n", humanize.IBytes(uint64(p.min)), humanize.IBytes(uint64(p.max)))
+	p.active = true
+	p.received, p.lost = 0, p.max+1
+	p.size = p.min
+	p.id++
+	p.attempts = 0
+	p.lastSent = time.Time{}
+}
+
+// checkProbe sends the next probe if necessary and returns whether probing
+// is still in progress.
+func (c *Channel) checkProbe() bool {
+	p := &c.probe
+	if !p.active {
+		return false
+	}
+	if !p.lastSent.IsZero() && time.Now().Sub(p.lastSent) < c.resyncTimeout() {
+		return true
+	}
+	if p.attempts >= probeAttempts {
+		c.debugLogger.Printf("probe of %s lost\n", humanize.IBytes(uint64(p.size)))
+		p.lost = p.size
+		if !c.nextProbe() {
+			return false
+		}
+	}
+	payload := make([]byte, p.size)
+	if _, err := io.ReadFull(rand.Reader, payload); err != nil {
+		c.errorLogger.Println("cannot create probe:", err)
+		return true
+	}
+	p.attempts++
+	p.lastSent = time.Now()
+	c.writePacket(CBPacket{Target: c.peerHeader, Session: c.session, Type: PacketTypeProbe, Seq: -1, Ack: -1,
+		Payload: fmt.Sprintf("PROBE:%d:%s", p.id, payload)})
+	return true
+}
+
+// nextProbe selects the size of the next probe, or finishes probing.
+func (c *Channel) nextProbe() bool {
+	p := &c.probe
+	p.id++
+	p.attempts = 0
+	p.lastSent = time.Time{}
+	switch {
+	case p.lost > p.max && p.received < p.max:
+		// nothing lost so far
+		p.size = 2 * p.received
+		if p.size > p.max {
+			p.size = p.max
+		}
+		return true
+	case p.lost <= p.min || p.lost-p.received <= p.received/probePrecision:
+		c.finishProbing()
+		return false
+	default:
+		p.size = (p.received + p.lost) / 2
+		return true
+	}
+}
+
+func (c *Channel) finishProbing() {
+	p := &c.probe
+	p.active = false
+	size := p.received
+	if size == 0 {
+		c.errorLogger.Printf("even probes of the minimum blocksize (%s) got lost\n", humanize.IBytes(uint64(p.min)))
+		size = p.min
+	}
+	c.setBlocksizeLimit(size)
+	go c.sendControl(fmt.Sprintf("BLOCKSIZE:%d", size))
+}
+
+// setBlocksizeLimit sets the blocksize (and the upper bound for
+// auto-tuning) to the result of probing.
+func (c *Channel) setBlocksizeLimit(size int) {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	c.bufferSize = size
+	if c.autoTune {
+		c.tuner.maxBlocksize = size
+		if c.tuner.minBlocksize > size {
+			c.tuner.minBlocksize = size
+		}
+	}
+	c.debugLogger.Println("probing finished, using blocksize", humanize.IBytes(uint64(size)))
+}
+
+func (c *Channel) processProbePacket(packet CBPacket) {
+	args := strings.SplitN(packet.Payload, ":", 3)
+	if len(args) != 3 {
+		c.debugLogger.Println("received malformed probe")
+		return
+	}
+	switch {
+	case args[0] == "PROBE" && c.ownHeader == SERVER:
+		c.writePacket(CBPacket{Target: c.peerHeader, Session: c.session, Type: PacketTypeProbe, Seq: -1, Ack: -1,
+			Payload: fmt.Sprintf("PROBE-ACK:%s:%d", args[1], len(args[2]))})
+	case args[0] == "PROBE-ACK" && c.ownHeader == CLIENT:
+		p := &c.probe
+		if id, err := strconv.Atoi(args[1]); !p.active || err != nil || id != p.id {
+			return
+		}
+		c.debugLogger.Printf("probe of %s received\n", humanize.IBytes(uint64(p.size)))
+		p.received = p.size
+		c.nextProbe()
+	}
+}
+
+// countDecodeFailure keeps track of packets in a row that could not be
+// decoded, which indicates the blocksize is too large.
+func (c *Channel) countDecodeFailure(failed bool) {
+	p := &c.probe
+	if !failed {
+		p.failures = 0
+		return
+	}
+	p.failures++
+	if p.failures >= probeFailureThreshold && c.handshake.confirmed {
+		p.failures = 0
+		c.debugLogger.Println("cannot decode packets, probing blocksize again")
+		c.startProbing()
+	}
+}
@@ -0,0 +1,131 @@
+package channel
+
+import (
+	"github.com/svent/cliptun/transport"
+)
+
+// Packets waiting to be sent are queued by priority. Control packets (e.g.
+// START-SOCKS or BLOCKSIZE) are queued separately and sent before any data
+// queued, even if the send window is full, as they do not count towards
+// it. On the clipboard, which only holds the last content written, they
+// are written along with the packets still in flight instead of replacing
+// them, so they piggyback on the data sent.
+//
+// Data keeps the order it was passed to Send in, so interactive data
+// cannot overtake bulk data queued before. Instead, bulk data (anything
+// larger than interactiveSize passed to Send at once) only takes up half
+// the queue (or as many entries as the send window can take in a round,
+// if that is more). Small writes, like keystrokes sent during a large
+// transfer, only wait for those packets instead of a full queue.
+//
+// The FIN sent on Close follows the data queued before. Abort drops that
+// data instead, so the FIN is sent right away.
+
+const (
+	// data passed to Send at once up to this size is not bulk data
+	interactiveSize = 1024
+	// the number of packets of bulk data queued at most (unless the send
+	// window is larger)
+	bulkQueueSize = QueueSize / 2
+)
+
+// Abort closes the channel like Close, but drops the data not sent yet, so
+// the peer is told right away.
+func (c *Channel) Abort() error {
+	c.abort()
+	c.close(nil)
+	<-c.done
+	return c.Err()
+}
+
+// abort drops the data not sent yet, and all data passed to Send from now
+// on.
+func (c *Channel) abort() {
+	c.abortOnce.Do(func() {
+		c.debugLogger.Println("dropping data not sent yet")
+		close(c.aborted)
+	})
+}
+
+func (c *Channel) isAborted() bool {
+	select {
+	case <-c.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquireBulkSlot waits until another packet of bulk data may be queued.
+func (c *Channel) acquireBulkSlot(cancel <-chan struct{}) error {
+	select {
+	case c.bulkSlots <- struct{}{}:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	case <-c.aborted:
+		return ErrClosed
+	case <-c.writeDeadline.wait():
+		return timeoutError{}
+	case <-cancel:
+		return ErrClosed
+	}
+}
+
+// dequeue takes the next packet from sendChan, if any.
+func (c *Channel) dequeue() (CBPacket, bool) {
+	select {
+	case p := <-c.sendChan:
+		if p.bulk {
+			<-c.bulkSlots
+		}
+		return p, true
+	default:
+		return CBPacket{}, false
+	}
+}
+
+// nextPacket returns the next packet queued for sending, if any. Control
+// packets come first, data is only returned if the send window is not
+// full.
+func (c *Channel) nextPacket(windowFull bool) (CBPacket, bool) {
+	if c.resume.sendAck {
+		// the peer discards all data it receives before
+		c.resume.sendAck = false
+		return CBPacket{Target: c.peerHeader, Type: PacketTypeControl, Payload: "RESUME-ACK"}, true
+	}
+	select {
+	case p := <-c.controlChan:
+		return p, true
+	default:
+	}
+	if windowFull {
+		return CBPacket{}, false
+	}
+	for {
+		var p CBPacket
+		if len(c.resume.queued) > 0 {
+			p, c.resume.queued = c.resume.queued[0], c.resume.queued[1:]
+		} else {
+			var ok bool
+			if p, ok = c.dequeue(); !ok {
+				return CBPacket{}, false
+			}
+		}
+		if p.cancelled() || p.Type == PacketTypeData && c.isAborted() {
+			continue
+		}
+		return p, true
+	}
+}
+
+// writeFollowing writes an encoded packet to the transport. On the
+// clipboard, it is appended to the packets written before if follow is set
+// (see appendText), as those have not been acknowledged yet.
+func (c *Channel) writeFollowing(s string, follow bool) {
+	if _, ok := c.transport.(*transport.Clipboard); ok && follow {
+		c.appendText(s)
+		return
+	}
+	c.writeText(s)
+}
@@ -0,0 +1,96 @@
+package channel
+
+import (
+	"crypto/sha256"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Long-running sessions switch to new keys from time to time. The client
+// sends a REKEY control packet once one of the configured thresholds has
+// been reached, the server answers with a REKEY-ACK. Each side encrypts
+// all packets sent after its REKEY or REKEY-ACK packet with the next key,
+// which is derived from the current key (so old keys cannot be recovered
+// from new ones). The receiving side switches to the next key once the
+// control packet has been delivered; until then it accepts packets
+// encrypted with the current and the next key, as later packets may
+// arrive first.
+
+type rekeyState struct {
+	packets  int64
+	bytes    int64
+	lastTime time.Time
+	pending  bool
+	epoch    int
+}
+
+// nextKey derives the key following the given one.
+func nextKey(key *[32]byte) [32]byte {
+	var next [32]byte
+	kdf := hkdf.New(sha256.New, key[:], nil, []byte("cliptun rekey"))
+	if _, err := io.ReadFull(kdf, next[:]); err != nil {
+		// reading 32 bytes from hkdf cannot fail
+		panic(err)
+	}
+	return next
+}
+
+func isRekeyPacket(p CBPacket) bool {
+	return p.Type == PacketTypeControl && (p.Payload == "REKEY" || p.Payload == "REKEY-ACK")
+}
+
+// advanceSendKey switches to the next key for sending.
+func (c *Channel) advanceSendKey() {
+	next := nextKey(&c.sendKey)
+	wipe(c.sendKey[:])
+	c.sendKey = next
+}
+
+// advanceRecvKey switches to the next key for receiving.
+func (c *Channel) advanceRecvKey() {
+	wipe(c.recvKey[:])
+	c.recvKey = c.nextRecvKey
+	c.nextRecvKey = nextKey(&c.recvKey)
+}
+
+// countTraffic adds a sent or received packet to the rekey thresholds.
+func (c *Channel) countTraffic(p CBPacket) {
+	c.rekey.packets++
+	c.rekey.bytes += int64(len(p.Payload))
+}
+
+// checkRekey starts a rekey if one of the thresholds has been reached.
+// Only the client initiates rekeying.
+func (c *Channel) checkRekey() {
+	r := &c.rekey
+	if c.ownHeader != CLIENT || r.pending {
+		return
+	}
+	if r.lastTime.IsZero() {
+		r.lastTime = time.Now()
+	}
+	if (c.rekeyPackets <= 0 || r.packets < c.rekeyPackets) &&
+		(c.rekeyBytes <= 0 || r.bytes < c.rekeyBytes) &&
+		(c.rekeyInterval <= 0 || time.Now().Sub(r.lastTime) < c.rekeyInterval) {
+		return
+	}
+	c.debugLogger.Println("rekey threshold reached, switching to new keys")
+	r.pending = true
+	go c.sendControl("REKEY")
+}
+
+// processRekeyPacket is called once a REKEY or REKEY-ACK packet has been
+// delivered.
+func (c *Channel) processRekeyPacket(cmd string) {
+	c.advanceRecvKey()
+	if cmd == "REKEY" {
+		go c.sendControl("REKEY-ACK")
+	}
+	r := &c.rekey
+	r.epoch++
+	r.pending = false
+	r.packets, r.bytes, r.lastTime = 0, 0, time.Now()
+	c.debugLogger.Println("switched to new keys, epoch", r.epoch)
+}
@@ -0,0 +1,104 @@
+package channel
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRekeyRetransmission(t *testing.T) {
+	sender, receiver := testChannel(CLIENT, ""), testChannel(SERVER, "")
+	receiver.nextRecvKey = nextKey(&receiver.recvKey)
+	receiver.debugLogger = newLevelLogger(nil, LevelDebug)
+	receiver.controlChan = make(chan CBPacket, 1)
+	oldKey := sender.sendKey
+
+	// send encodes a packet like the clipboard loop, which switches to the
+	// next key right after sending the REKEY packet for the first time
+	retransmit := func(p CBPacket) string {
+		encoded, err := sender.packet2string(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	send := func(p CBPacket) string {
+		encoded := retransmit(p)
+		if isRekeyPacket(p) {
+			sender.advanceSendKey()
+		}
+		return encoded
+	}
+	packets := []CBPacket{
+		{Target: SERVER, Seq: 0, Payload: "old key"},
+		{Target: SERVER, Seq: 1, Payload: "old key, retransmitted"},
+		{Target: SERVER, Seq: 2, Type: PacketTypeControl, Payload: "REKEY"},
+		{Target: SERVER, Seq: 3, Payload: "new key"},
+		{Target: SERVER, Seq: 4, Payload: "new key, after the switch"},
+	}
+	var encoded []string
+	for _, p := range packets {
+		encoded = append(encoded, send(p))
+	}
+	if sender.sendKey != nextKey(&oldKey) {
+		t.Fatal("sender did not switch to the next key")
+	}
+	// packet 1 is lost and retransmitted using the next key, along with
+	// the REKEY packet, after packet 3 arrived
+	retransmitted := []string{retransmit(packets[1]), retransmit(packets[2])}
+
+	// the packets arrive out of order and more than once, the receiver
+	// delivers them in order and switches keys once the REKEY is delivered
+	arrivals := []string{encoded[0], encoded[3], retransmitted[0], encoded[2], retransmitted[1], encoded[4]}
+	lastRecvIndex := -1
+	queue := make(map[int]CBPacket)
+	for i, data := range arrivals {
+		p, err := receiver.string2packet(data)
+		if err != nil {
+			t.Fatalf("arrival %d: %s", i, err)
+		}
+		if p.Seq > lastRecvIndex {
+			queue[p.Seq] = p
+		}
+		for {
+			p, ok := queue[lastRecvIndex+1]
+			if !ok {
+				break
+			}
+			lastRecvIndex++
+			delete(queue, lastRecvIndex)
+			if want := packets[lastRecvIndex].Payload; p.Payload != want {
+				t.Errorf("packet %d: got %q, want %q", lastRecvIndex, p.Payload, want)
+			}
+			if p.Type == PacketTypeControl {
+				if err := receiver.processControlPacket(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	if lastRecvIndex != len(packets)-1 {
+		t.Fatalf("delivered %d packets, want %d", lastRecvIndex+1, len(packets))
+	}
+	if receiver.recvKey != sender.sendKey || receiver.rekey.epoch != 1 {
+		t.Errorf("receiver did not switch to the next key (epoch %d)", receiver.rekey.epoch)
+	}
+	if p := <-receiver.controlChan; p.Payload != "REKEY-ACK" {
+		t.Errorf("got %q, want REKEY-ACK", p.Payload)
+	}
+
+	// packets sent using the new key cannot be read using the old one, the
+	// old key is not accepted anymore once both sides switched
+	old := testChannel(SERVER, "")
+	old.recvKey, old.nextRecvKey = oldKey, oldKey
+	if _, err := old.string2packet(encoded[3]); err == nil {
+		t.Error("packet sent after the REKEY decrypted using the old key")
+	}
+	if _, err := receiver.string2packet(encoded[0]); err == nil {
+		t.Error("old key still accepted after the switch")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := receiver.string2packet(send(CBPacket{Target: SERVER, Seq: 5 + i, Payload: fmt.Sprint(i)})); err != nil {
+			t.Errorf("packet using the new key: %s", err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package channel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// With a session file, the state of the session is saved whenever it
+// changes, so a restarted cliptun process can rejoin the session instead
+// of starting a new one. The file contains the session ID, the current
+// keys, the sequence numbers and the packets not acknowledged by the peer
+// yet, and is sealed using a key derived from the password. It is saved
+// before new packets are written, so a restarted process never reuses a
+// sequence number, and removed on a regular shutdown (but kept if the
+// channel is suspended, see Suspend). As the session keys can be read
+// from the file using the password, recorded traffic of the session is
+// not protected by forward secrecy anymore once the password becomes
+// known.
+//
+// The data of the process that was restarted is lost, so both sides have
+// to start over on the level of the application. The resumed peer sends a
+// RESUME control packet, the peer kept running calls the ResumeCallback and
+// answers with a RESUME-ACK, which is sent before any other data. Until
+// the RESUME-ACK arrives, the resumed peer discards all data received, as
+// it still belongs to the previous process. If the RESUME is not answered
+// in time (e.g. because the peer has been restarted without the session
+// as well), a new session is started.
+
+// number of resync timeouts to wait for the RESUME-ACK before starting a
+// new session
+const resumeAttempts = 16
+
+// ResumeCallback is called once the peer rejoined the session after being
+// restarted. All data sent before is lost on the peer's side, data passed
+// to Send before the callback returns is dropped. The callback must not
+// call Send itself.
+type ResumeCallback func()
+
+type resumeState struct {
+	// set while waiting for the RESUME-ACK of a resumed session
+	pending bool
+	started time.Time
+	// the sequence numbers loaded from the session file
+	sendIndex   int
+	recvIndex   int
+	ackReceived int
+	// the peer resumed the session, the RESUME-ACK is sent next, followed
+	// by the packets queued while it was resumed
+	sendAck bool
+	queued  []CBPacket
+	// the sequence numbers last saved
+	saved      [3]int
+	saveFailed bool
+}
+
+type savedSession struct {
+	Peer        PeerType
+	Session     uint64
+	SendKey     []byte
+	RecvKey     []byte
+	Codec       string
+	Encoding    string
+	SendIndex   int
+	RecvIndex   int
+	AckReceived int
+	// packets not acknowledged by the peer yet
+	Unacked []savedPacket
+}
+
+type savedPacket struct {
+	Frame []byte
+	More  bool
+}
+
+// sessionFileKey derives the key for sealing the session file.
+func (c *Channel) sessionFileKey() [32]byte {
+	var key [32]byte
+	kdf := hkdf.New(sha256.New, c.masterKey[:], nil, []byte("cliptun session file"))
+	if _, err := io.ReadFull(kdf, key[:]); err != nil {
+		// reading 32 bytes from hkdf cannot fail
+		panic(err)
+	}
+	return key
+}
+
+// saveSession writes the state of the session to the session file if the
+// sequence numbers changed since it was saved last.
+func (c *Channel) saveSession(sendIndex, recvIndex, ackReceived int) {
+	r := &c.resume
+	if c.sessionFile == "" || !c.handshake.confirmed || r.saved == [3]int{sendIndex, recvIndex, ackReceived} {
+		return
+	}
+	s := savedSession{
+		Peer:        c.ownHeader,
+		Session:     c.session,
+		SendKey:     c.sendKey[:],
+		RecvKey:     c.recvKey[:],
+		Codec:       c.codec.name,
+		Encoding:    c.encoding.name,
+		SendIndex:   sendIndex,
+		RecvIndex:   recvIndex,
+		AckReceived: ackReceived,
+	}
+	for seq := ackReceived + 1; seq <= sendIndex; seq++ {
+		p := c.sendQueue[seq]
+		s.Unacked = append(s.Unacked, savedPacket{Frame: encodeFrame(p), More: p.More})
+	}
+	if err := c.writeSessionFile(s); err != nil {
+		if !r.saveFailed {
+			c.errorLogger.Println("cannot save session:", err)
+		}
+		r.saveFailed = true
+		return
+	}
+	r.saveFailed = false
+	r.saved = [3]int{sendIndex, recvIndex, ackReceived}
+}
+
+func (c *Channel) writeSessionFile(s savedSession) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return fmt.Errorf("cannot get random bytes for nonce: %s", err)
+	}
+	key := c.sessionFileKey()
+	defer wipe(key[:])
+	sealed := secretbox.Seal(nonce[:], data, &nonce, &key)
+	// replace the file at once, so a crash does not leave a partial file
+	tmp := c.sessionFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.sessionFile)
+}
+
+// loadSession resumes the session saved in the session file, if any.
+func (c *Channel) loadSession() error {
+	sealed, err := ioutil.ReadFile(c.sessionFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read session file: %s", err)
+	}
+	if len(sealed) < 24 {
+		return fmt.Errorf("session file is truncated")
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	key := c.sessionFileKey()
+	defer wipe(key[:])
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, &key)
+	if !ok {
+		return fmt.Errorf("cannot decrypt session file, it was saved using another password or key")
+	}
+	defer wipe(data)
+	var s savedSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("cannot parse session file: %s", err)
+	}
+	defer wipe(s.SendKey)
+	defer wipe(s.RecvKey)
+	if s.Peer != c.ownHeader {
+		return fmt.Errorf("session file belongs to the other side of the tunnel")
+	}
+	if len(s.SendKey) != keySize || len(s.RecvKey) != keySize || codecByName(s.Codec) == nil || encodingByName(s.Encoding) == nil {
+		return fmt.Errorf("session file is invalid")
+	}
+	if s.AckReceived > s.SendIndex || len(s.Unacked) != s.SendIndex-s.AckReceived {
+		return fmt.Errorf("session file is invalid")
+	}
+	for i, saved := range s.Unacked {
+		p, err := decodeFrame(saved.Frame)
+		if err != nil {
+			return fmt.Errorf("session file is invalid: %s", err)
+		}
+		p.More = saved.More
+		c.sendQueue[s.AckReceived+1+i] = p
+	}
+
+	c.session = s.Session
+	copy(c.sendKey[:], s.SendKey)
+	copy(c.recvKey[:], s.RecvKey)
+	c.nextRecvKey = nextKey(&c.recvKey)
+	c.codec = codecByName(s.Codec)
+	c.encoding = encodingByName(s.Encoding)
+	c.handshake.established = true
+	c.handshake.confirmed = true
+	c.resume = resumeState{
+		pending:     true,
+		sendIndex:   s.SendIndex,
+		recvIndex:   s.RecvIndex,
+		ackReceived: s.AckReceived,
+		saved:       [3]int{s.SendIndex, s.RecvIndex, s.AckReceived},
+	}
+	c.debugLogger.Printf("resuming session %016x (sent: %d, received: %d)\n", c.session, s.SendIndex+1, s.RecvIndex+1)
+	c.sendControl("RESUME")
+	return nil
+}
+
+// Suspend stops the channel without telling the peer, and keeps the
+// session file, so a process started again with the file rejoins the
+// session. The data not sent yet is dropped. Without a session file, the
+// channel is aborted like Abort.
+func (c *Channel) Suspend() error {
+	if c.sessionFile == "" {
+		return c.Abort()
+	}
+	c.abort()
+	c.closeOnce.Do(func() {
+		c.stopOnce.Do(func() {
+			c.debugLogger.Println("suspending session, it can be resumed using the session file")
+			c.keepSession = true
+			close(c.stopping)
+		})
+	})
+	<-c.done
+	return c.Err()
+}
+
+// removeSession removes the session file, as the session cannot be
+// resumed anymore.
+func (c *Channel) removeSession() {
+	if c.sessionFile == "" {
+		return
+	}
+	if err := os.Remove(c.sessionFile); err != nil && !os.IsNotExist(err) {
+		c.errorLogger.Println("cannot remove session file:", err)
+	}
+}
+
+// peerResumed is called once the peer rejoined the session after a
+// restart. Data not sent yet belongs to the previous process of the peer
+// and is dropped, unless it was passed to a connection opened by the
+// callback (which is still open).
+func (c *Channel) peerResumed() {
+	c.errorLogger.Println("peer rejoined the session after a restart")
+	c.fragments = nil
+	if c.resumeCallback != nil {
+		c.resumeCallback()
+	}
+	for {
+		p, ok := c.dequeue()
+		if !ok {
+			break
+		}
+		if p.Type == PacketTypeControl || p.cancel != nil && !p.cancelled() {
+			c.resume.queued = append(c.resume.queued, p)
+		}
+	}
+	c.resume.sendAck = true
+}
+
+// resumeConfirmed is called once the peer answered the RESUME.
+func (c *Channel) resumeConfirmed() {
+	if !c.resume.pending {
+		return
+	}
+	c.resume.pending = false
+	c.fragments = nil
+	c.debugLogger.Printf("peer connected (resumed session %016x)\n", c.session)
+	c.statsConnected()
+	close(c.connected)
+	if c.ownHeader == CLIENT {
+		c.startProbing()
+	}
+}
+
+// checkResume starts a new session if the RESUME has not been answered in
+// time, and returns whether the session has been abandoned.
+func (c *Channel) checkResume() bool {
+	r := &c.resume
+	if !r.pending {
+		return false
+	}
+	if r.started.IsZero() {
+		r.started = time.Now()
+	}
+	if time.Now().Sub(r.started) < resumeAttempts*c.resyncTimeout() {
+		return false
+	}
+	c.errorLogger.Println("peer did not answer, cannot resume session, starting a new one")
+	r.pending = false
+	c.removeSession()
+	c.sendQueue = make(map[int]CBPacket)
+	c.receiveQueue = make(map[int]CBPacket)
+	c.fragments = nil
+	c.session = 0
+	wipe(c.sendKey[:])
+	wipe(c.recvKey[:])
+	wipe(c.nextRecvKey[:])
+	c.handshake = handshakeState{}
+	c.encoding = encodingByName(defaultEncoding)
+	c.codec = codecByName(defaultCodec)
+	return true
+}
@@ -0,0 +1,173 @@
+package channel
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sessionChannel returns a channel with a confirmed session, which saves
+// it to a file in dir.
+func sessionChannel(typ PeerType, dir string) *Channel {
+	c := testChannel(typ, "")
+	c.handshake.confirmed = true
+	c.sessionFile = filepath.Join(dir, "session")
+	c.sendQueue = make(map[int]CBPacket)
+	c.resume.saved = [3]int{-1, -1, -1}
+	c.debugLogger = newLevelLogger(nil, LevelDebug)
+	c.errorLogger = newLevelLogger(nil, LevelError)
+	return c
+}
+
+func TestSuspend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliptun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, suspend := range []bool{false, true} {
+		c := sessionChannel(CLIENT, dir)
+		c.transport = &memClipboard{}
+		c.sendChan = make(chan CBPacket, 1)
+		c.stopping = make(chan struct{})
+		c.done = make(chan struct{})
+		c.aborted = make(chan struct{})
+		c.saveSession(-1, 3, -1)
+		go func() {
+			<-c.stopping
+			c.shutdown()
+		}()
+
+		if suspend {
+			if err := c.Suspend(); err != nil {
+				t.Errorf("suspended channel failed: %s", err)
+			}
+			// the channel has been closed without telling the peer
+			c.close(nil)
+			if len(c.sendChan) != 0 {
+				t.Errorf("suspended channel sent %+v", <-c.sendChan)
+			}
+		} else {
+			c.stop(nil)
+			<-c.done
+		}
+		_, err := os.Stat(c.sessionFile)
+		if suspend && err != nil {
+			t.Errorf("session file not kept after suspending: %s", err)
+		}
+		if !suspend && !os.IsNotExist(err) {
+			t.Errorf("session file kept after closing the channel: %v", err)
+		}
+	}
+}
+
+func TestSessionRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliptun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saver := sessionChannel(CLIENT, dir)
+	saver.masterKey = [32]byte{9}
+	saver.sendKey = [32]byte{4, 5, 6}
+	saver.recvKey = [32]byte{7, 8, 9}
+	saver.codec = codecByName("brotli")
+	saver.encoding = encodingByName("base85")
+	packets := fecGroupPackets(saver, 3, 2)
+	for _, p := range packets {
+		saver.sendQueue[p.Seq] = p
+	}
+	saver.saveSession(4, 7, 2)
+
+	c := sessionChannel(CLIENT, dir)
+	c.masterKey = saver.masterKey
+	c.session = 0
+	c.controlChan = make(chan CBPacket, 1)
+	if err := c.loadSession(); err != nil {
+		t.Fatal(err)
+	}
+	if c.session != saver.session || c.sendKey != saver.sendKey || c.recvKey != saver.recvKey || c.nextRecvKey != nextKey(&saver.recvKey) {
+		t.Error("session ID or keys not restored")
+	}
+	if c.codec.name != "brotli" || c.encoding.name != "base85" {
+		t.Errorf("got codec %s and encoding %s, want brotli and base85", c.codec.name, c.encoding.name)
+	}
+	if r := c.resume; !r.pending || r.sendIndex != 4 || r.recvIndex != 7 || r.ackReceived != 2 {
+		t.Errorf("got resume state %+v", r)
+	}
+	for _, p := range packets {
+		// acknowledgements are updated when the packet is sent again, and
+		// sessions using stream compression are never saved
+		got := c.sendQueue[p.Seq]
+		if got.Seq != p.Seq || got.Type != p.Type || got.Payload != p.Payload || got.More != p.More {
+			t.Errorf("packet %d: got %+v, want %+v", p.Seq, got, p)
+		}
+	}
+	select {
+	case p := <-c.controlChan:
+		if p.Payload != "RESUME" {
+			t.Errorf("got control packet %q, want RESUME", p.Payload)
+		}
+	default:
+		t.Error("no RESUME sent")
+	}
+}
+
+func TestSessionRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cliptun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		// changes the channel loading the file, or the file
+		modify func(c *Channel, sealed []byte) []byte
+	}{
+		{"other password", func(c *Channel, sealed []byte) []byte {
+			c.masterKey[0]++
+			return sealed
+		}},
+		{"other side", func(c *Channel, sealed []byte) []byte {
+			c.ownHeader, c.peerHeader = SERVER, CLIENT
+			return sealed
+		}},
+		{"truncated", func(c *Channel, sealed []byte) []byte {
+			return sealed[:len(sealed)-1]
+		}},
+		{"too short", func(c *Channel, sealed []byte) []byte {
+			return sealed[:10]
+		}},
+		{"tampered", func(c *Channel, sealed []byte) []byte {
+			sealed[len(sealed)/2] ^= 1
+			return sealed
+		}},
+	}
+	for _, tt := range tests {
+		saver := sessionChannel(CLIENT, dir)
+		saver.saveSession(-1, 0, -1)
+		sealed, err := ioutil.ReadFile(saver.sessionFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := sessionChannel(CLIENT, dir)
+		c.session = 0
+		if err := ioutil.WriteFile(c.sessionFile, tt.modify(c, sealed), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.loadSession(); err == nil {
+			t.Errorf("%s: session file loaded", tt.name)
+		}
+		if c.session != 0 || c.resume.pending {
+			t.Errorf("%s: session resumed from rejected file", tt.name)
+		}
+	}
+
+	// without a session file, a new session is started
+	c := sessionChannel(CLIENT, dir)
+	c.sessionFile = filepath.Join(dir, "missing")
+	if err := c.loadSession(); err != nil || c.resume.pending {
+		t.Errorf("missing session file: got %v, resuming %v", err, c.resume.pending)
+	}
+}
@@ -0,0 +1,85 @@
+package channel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Stats holds the counters of a channel, as returned by Stats.
+type Stats struct {
+	// packets written to and read from the transport (including handshake
+	// packets, probes and retransmissions), and the size of their text
+	PacketsSent     int64
+	PacketsReceived int64
+	BytesSent       int64
+	BytesReceived   int64
+	// data passed to Send and delivered to Receive
+	DataSent     int64
+	DataReceived int64
+	// packets sent again after a resync, and the number of resyncs
+	Retransmissions int64
+	Resyncs         int64
+	// packets reconstructed using forward error correction
+	Recovered int64
+	// packets read from the transport that could not be decrypted
+	DecryptionFailures int64
+	// the smoothed round trip time
+	RTT time.Duration
+	// data sent and received per second since the peer connected
+	Throughput float64
+	// packets passed to Send but not sent yet
+	QueueDepth int
+	// time since the peer connected (0 if not connected yet)
+	Connected time.Duration
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("sent %d packets (%s, data: %s), received %d packets (%s, data: %s), "+
+		"%d retransmissions, %d resyncs, %d recovered, %d decryption failures, rtt %s, throughput %s/s, %d queued",
+		s.PacketsSent, humanize.IBytes(uint64(s.BytesSent)), humanize.IBytes(uint64(s.DataSent)),
+		s.PacketsReceived, humanize.IBytes(uint64(s.BytesReceived)), humanize.IBytes(uint64(s.DataReceived)),
+		s.Retransmissions, s.Resyncs, s.Recovered, s.DecryptionFailures, s.RTT.Round(time.Millisecond),
+		humanize.IBytes(uint64(s.Throughput)), s.QueueDepth)
+}
+
+type statsState struct {
+	mutex     sync.Mutex
+	stats     Stats
+	connected time.Time
+}
+
+// Stats returns the current counters of the channel.
+func (c *Channel) Stats() Stats {
+	c.stats.mutex.Lock()
+	s := c.stats.stats
+	connected := c.stats.connected
+	c.stats.mutex.Unlock()
+
+	s.RTT = c.RTT()
+	s.QueueDepth = len(c.sendChan) + len(c.controlChan)
+	if !connected.IsZero() {
+		s.Connected = time.Now().Sub(connected)
+		if seconds := s.Connected.Seconds(); seconds > 0 {
+			s.Throughput = float64(s.DataSent+s.DataReceived) / seconds
+		}
+	}
+	return s
+}
+
+// updateStats changes the counters of the channel.
+func (c *Channel) updateStats(update func(s *Stats)) {
+	c.stats.mutex.Lock()
+	defer c.stats.mutex.Unlock()
+	update(&c.stats.stats)
+}
+
+// statsConnected is called once the peer connected, the throughput is
+// measured from then on.
+func (c *Channel) statsConnected() {
+	c.stats.mutex.Lock()
+	defer c.stats.mutex.Unlock()
+	c.stats.connected = time.Now()
+}
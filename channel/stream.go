@@ -0,0 +1,112 @@
+package channel
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// With stream compression enabled, the payloads of data packets are
+// compressed by a deflate stream kept for the whole session, so small
+// packets benefit from the data sent before. Every payload is flushed
+// individually and prefixed by its uncompressed length, so the receiver
+// can decompress it without waiting for following packets.
+//
+// A payload is compressed once the packet gets its sequence number and
+// the receiver decompresses it once the packet is delivered in order, so
+// both sides process the stream in the same order. As retransmissions
+// (e.g. after a resync) contain the same compressed payload, the stream
+// is not affected by lost packets. Both streams start over with every new
+// session.
+
+// upper bound for the uncompressed size of a payload
+const maxStreamPayload = 64 * 1024 * 1024
+
+type streamCompressor struct {
+	buf bytes.Buffer
+	w   *flate.Writer
+}
+
+func newStreamCompressor() *streamCompressor {
+	s := &streamCompressor{}
+	// only the highest level finds matches in data written before the last
+	// flush, cannot fail for a valid compression level
+	s.w, _ = flate.NewWriter(&s.buf, flate.BestCompression)
+	return s
+}
+
+func (s *streamCompressor) compress(data string) (string, error) {
+	s.buf.Reset()
+	var length [binary.MaxVarintLen64]byte
+	s.buf.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+	if _, err := io.WriteString(s.w, data); err != nil {
+		return "", err
+	}
+	if err := s.w.Flush(); err != nil {
+		return "", err
+	}
+	return s.buf.String(), nil
+}
+
+type streamDecompressor struct {
+	src bytes.Buffer
+	r   io.Reader
+}
+
+func newStreamDecompressor() *streamDecompressor {
+	s := &streamDecompressor{}
+	s.r = flate.NewReader(&s.src)
+	return s
+}
+
+func (s *streamDecompressor) decompress(data string) (string, error) {
+	r := bytes.NewReader([]byte(data))
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > maxStreamPayload {
+		return "", fmt.Errorf("bad payload length")
+	}
+	s.src.Write([]byte(data[len(data)-r.Len():]))
+	// read exactly the flushed payload, reading beyond it would fail as
+	// the following data is not available yet
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(s.r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// compressStream compresses the payload of a data packet about to be sent.
+func (c *Channel) compressStream(p *CBPacket) error {
+	if !c.streamCompression || p.Type != PacketTypeData || p.Payload == "" {
+		return nil
+	}
+	if c.sendStream == nil {
+		c.sendStream = newStreamCompressor()
+	}
+	payload, err := c.sendStream.compress(p.Payload)
+	if err != nil {
+		return fmt.Errorf("cannot compress packet: %s", err)
+	}
+	p.Payload = payload
+	p.Streamed = true
+	return nil
+}
+
+// decompressStream decompresses the payload of a packet delivered in order.
+func (c *Channel) decompressStream(p *CBPacket) error {
+	if !p.Streamed {
+		return nil
+	}
+	if c.recvStream == nil {
+		c.recvStream = newStreamDecompressor()
+	}
+	payload, err := c.recvStream.decompress(p.Payload)
+	if err != nil {
+		return fmt.Errorf("cannot decompress packet, compression stream is broken: %s", err)
+	}
+	p.Payload = payload
+	p.Streamed = false
+	return nil
+}
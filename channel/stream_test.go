@@ -0,0 +1,135 @@
+package channel
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// streamPayloads returns payloads of all kinds, in the order sent.
+func streamPayloads() []string {
+	random := make([]byte, 100*1024)
+	rand.Read(random)
+	var payloads []string
+	for i := 0; i < 50; i++ {
+		payloads = append(payloads, fmt.Sprintf("user@host:~$ ls /tmp/%d\n", i), "")
+		if i%10 == 0 {
+			payloads = append(payloads, string(random), strings.Repeat("cliptun ", 20000))
+		}
+	}
+	return payloads
+}
+
+func TestStreamRoundtrip(t *testing.T) {
+	sender, receiver := testChannel(CLIENT, ""), testChannel(SERVER, "")
+	sender.streamCompression, receiver.streamCompression = true, true
+	small := 0
+	for i, payload := range streamPayloads() {
+		p := CBPacket{Seq: i, Payload: payload}
+		if err := sender.compressStream(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Streamed != (payload != "") {
+			t.Errorf("packet %d: streamed %v for a payload of %d bytes", i, p.Streamed, len(payload))
+		}
+		if strings.HasPrefix(payload, "user@host") && i > 10 && len(p.Payload) < len(payload)/2 {
+			small++
+		}
+		// the packet passes through the transport
+		encoded, err := sender.packet2string(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := receiver.string2packet(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := receiver.decompressStream(&got); err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if got.Payload != payload || got.Streamed {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, len(got.Payload), len(payload))
+		}
+	}
+	// small packets benefit from the similar ones sent before
+	if small == 0 {
+		t.Error("small payloads not compressed using the data sent before")
+	}
+
+	// control packets are not part of the stream
+	p := CBPacket{Type: PacketTypeControl, Payload: "FIN"}
+	if err := sender.compressStream(&p); err != nil || p.Streamed || p.Payload != "FIN" {
+		t.Errorf("control packet compressed: %+v, %v", p, err)
+	}
+	p = CBPacket{Payload: "\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", Streamed: true}
+	if err := receiver.decompressStream(&p); err == nil {
+		t.Error("payload exceeding the limit decompressed without error")
+	}
+}
+
+func TestStreamRetransmission(t *testing.T) {
+	sender, receiver := testChannel(CLIENT, ""), testChannel(SERVER, "")
+	sender.streamCompression, receiver.streamCompression = true, true
+	payloads := streamPayloads()
+	var sent []string
+	for i, payload := range payloads {
+		// the payload is compressed once, retransmissions send the packet
+		// kept in the send queue
+		p := CBPacket{Seq: i, Payload: payload}
+		if err := sender.compressStream(&p); err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := sender.packet2string(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, encoded)
+	}
+	// packets get lost, arrive out of order and more than once
+	var order []int
+	for i := range sent {
+		switch {
+		case i%7 == 3:
+			// lost, retransmitted after the next one
+		case i%7 == 4:
+			order = append(order, i, i-1, i-1, i)
+		default:
+			order = append(order, i, i)
+		}
+	}
+
+	// deliver the packets in order like the clipboard loop
+	queue := make(map[int]CBPacket)
+	lastRecvIndex := -1
+	var delivered []string
+	for _, i := range order {
+		p, err := receiver.string2packet(sent[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Seq > lastRecvIndex {
+			queue[p.Seq] = p
+		}
+		for {
+			p, ok := queue[lastRecvIndex+1]
+			if !ok {
+				break
+			}
+			lastRecvIndex++
+			delete(queue, lastRecvIndex)
+			if err := receiver.decompressStream(&p); err != nil {
+				t.Fatalf("packet %d: %s", p.Seq, err)
+			}
+			delivered = append(delivered, p.Payload)
+		}
+	}
+	if len(delivered) != len(payloads) {
+		t.Fatalf("got %d payloads, want %d", len(delivered), len(payloads))
+	}
+	for i := range payloads {
+		if delivered[i] != payloads[i] {
+			t.Errorf("payload %d: got %d bytes, want %d", i, len(delivered[i]), len(payloads[i]))
+		}
+	}
+}
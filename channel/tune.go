@@ -0,0 +1,144 @@
+package channel
+
+import (
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// number of packets that must be acknowledged without a resync before
+	// the link is tuned to be more aggressive
+	tuneAckThreshold = 8
+	// the bounds are divided into this many steps for additive changes
+	tuneSteps = 16
+)
+
+// linkTuner adjusts the polling interval and blocksize of a channel
+// (AIMD-style): every resync doubles the interval and halves the
+// blocksize, while a run of acknowledged packets decreases the interval
+// and increases the blocksize in small steps, always staying within the
+// configured bounds.
+type linkTuner struct {
+	minInterval  time.Duration
+	maxInterval  time.Duration
+	minBlocksize int
+	maxBlocksize int
+
+	acked int
+	// smoothed round trip time
+	rtt time.Duration
+}
+
+// Interval returns the current interval for polling the transport.
+func (c *Channel) Interval() time.Duration {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	return c.interval
+}
+
+// Blocksize returns the maximum amount of data that should be passed to
+// Send at once.
+func (c *Channel) Blocksize() int {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	return c.bufferSize
+}
+
+// RTT returns the smoothed round trip time measured for acknowledged
+// packets, or 0 if no packet has been acknowledged yet.
+func (c *Channel) RTT() time.Duration {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	return c.tuner.rtt
+}
+
+// updateRTT adds a new round trip sample to the smoothed round trip time
+// (using the same weight as TCP).
+func (c *Channel) updateRTT(sample time.Duration) {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	if c.tuner.rtt == 0 {
+		c.tuner.rtt = sample
+	} else {
+		c.tuner.rtt = (7*c.tuner.rtt + sample) / 8
+	}
+}
+
+// resyncTimeout returns how long to wait for an acknowledgement before
+// trying to resync.
+func (c *Channel) resyncTimeout() time.Duration {
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	timeout := 4 * c.interval
+	if 2*c.tuner.rtt > timeout {
+		timeout = 2 * c.tuner.rtt
+	}
+	return timeout
+}
+
+// tuneAcked is called for every packet acknowledged by the peer.
+func (c *Channel) tuneAcked() {
+	if !c.autoTune {
+		return
+	}
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	t := &c.tuner
+	t.acked++
+	if t.acked < tuneAckThreshold {
+		return
+	}
+	t.acked = 0
+
+	intervalStep := (t.maxInterval - t.minInterval) / tuneSteps
+	if intervalStep < time.Millisecond {
+		intervalStep = time.Millisecond
+	}
+	interval := c.interval - intervalStep
+	if interval < t.minInterval {
+		interval = t.minInterval
+	}
+
+	blocksizeStep := (t.maxBlocksize - t.minBlocksize) / tuneSteps
+	if blocksizeStep < 1 {
+		blocksizeStep = 1
+	}
+	blocksize := c.bufferSize + blocksizeStep
+	if blocksize > t.maxBlocksize {
+		blocksize = t.maxBlocksize
+	}
+	c.setLinkParameters(interval, blocksize)
+}
+
+// tuneResync is called whenever the channel had to resync.
+func (c *Channel) tuneResync() {
+	if !c.autoTune {
+		return
+	}
+	c.tuneMutex.Lock()
+	defer c.tuneMutex.Unlock()
+	t := &c.tuner
+	t.acked = 0
+
+	interval := 2 * c.interval
+	if interval > t.maxInterval {
+		interval = t.maxInterval
+	}
+	blocksize := c.bufferSize / 2
+	if blocksize < t.minBlocksize {
+		blocksize = t.minBlocksize
+	}
+	c.setLinkParameters(interval, blocksize)
+}
+
+// setLinkParameters must be called with tuneMutex held.
+func (c *Channel) setLinkParameters(interval time.Duration, blocksize int) {
+	if interval == c.interval && blocksize == c.bufferSize {
+		return
+	}
+	c.interval = interval
+	c.bufferSize = blocksize
+	c.debugLogger.Printf("auto-tune: interval %s, blocksize %s, rtt %s\n",
+		interval, humanize.IBytes(uint64(blocksize)), c.tuner.rtt.Round(time.Millisecond))
+}
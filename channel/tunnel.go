@@ -1,6 +1,7 @@
 package channel
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"os/exec"
 	"regexp"
 	"strconv"
+	"sync"
 
 	shellwords "github.com/mattn/go-shellwords"
 	"github.com/pkg/sftp"
@@ -20,9 +22,45 @@ import (
 )
 
 type Tunnel struct {
-	Channel
-	sshClientConn   *ssh.Client
-	socksListenPort int
+	*Channel
+	// sshConfig is the configuration of the internal ssh server
+	sshConfig *ssh.ServerConfig
+	// network is used for port forwardings and the SOCKS server
+	network string
+
+	// mutex protects the fields below, which change if the internal ssh
+	// connection is established again after the peer resumed the session
+	mutex             sync.Mutex
+	conn              *sshConn
+	sshClientConn     *ssh.Client
+	remoteForwardings []PortForwarding
+	socksListenPort   int
+	socksPort         string
+}
+
+// sshConn carries the internal ssh connection over the channel. It is
+// replaced once the peer resumed the session after a restart, closing it
+// only stops the ssh connection using it, not the channel.
+type sshConn struct {
+	*Channel
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *sshConn) Read(b []byte) (int, error) {
+	return s.Channel.read(b, s.closed)
+}
+
+func (s *sshConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return s.Channel.send(b, s.closed)
+}
+
+func (s *sshConn) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
 }
 
 type PortForwarding struct {
@@ -47,28 +85,51 @@ type forwardedTcpIpPayload struct {
 	RPort uint32
 }
 
-var (
-	network = "tcp4"
-)
-
 func NewTunnel(typ PeerType, options ChannelOptions) (*Tunnel, error) {
-	t := &Tunnel{}
+	return NewTunnelContext(context.Background(), typ, options)
+}
+
+// NewTunnelContext creates a tunnel that is closed once the context is
+// done.
+func NewTunnelContext(ctx context.Context, typ PeerType, options ChannelOptions) (*Tunnel, error) {
+	t := &Tunnel{network: options.Network}
+	if t.network == "" {
+		t.network = "tcp4"
+	}
 	options.ControlPacketCallback = func(cmd, arg string) {
-		debugLogger.Printf("control packet callback received: %s (%s)\n", cmd, arg)
+		t.debugLogger.Printf("control packet callback received: %s (%s)\n", cmd, arg)
 
 		switch cmd {
 		case "START-SOCKS":
 			t.startSOCKSServer()
 		case "SOCKS-AT":
-			t.AddLocalPortForwarding(PortForwarding{Port: strconv.Itoa(t.socksListenPort), Host: "localhost", HostPort: arg})
+			t.mutex.Lock()
+			started := t.socksPort != ""
+			t.socksPort = arg
+			port := t.socksListenPort
+			t.mutex.Unlock()
+			if !started {
+				t.listenLocal(strconv.Itoa(port), func() string {
+					t.mutex.Lock()
+					defer t.mutex.Unlock()
+					return "localhost:" + t.socksPort
+				})
+			}
 		}
 
 	}
-	c, err := NewChannel(typ, options)
+	options.ResumeCallback = func() {
+		if typ == CLIENT {
+			t.resumeClient()
+		} else {
+			t.resumeServer()
+		}
+	}
+	c, err := NewChannelContext(ctx, typ, options)
 	if err != nil {
 		return nil, err
 	}
-	t.Channel = *c
+	t.Channel = c
 	return t, nil
 }
 
@@ -83,7 +144,9 @@ func ParsePortForwarding(param string) (*PortForwarding, error) {
 }
 
 func (t *Tunnel) StartSocksOnPort(port int) {
+	t.mutex.Lock()
 	t.socksListenPort = port
+	t.mutex.Unlock()
 	t.sendControl("START-SOCKS")
 }
 
@@ -92,23 +155,23 @@ func (t *Tunnel) startSOCKSServer() {
 		conf := &socks5.Config{Logger: log.New(ioutil.Discard, "", log.LstdFlags)}
 		server, err := socks5.New(conf)
 		if err != nil {
-			errorLogger.Println("cannot create SOCKS server:", err)
+			t.errorLogger.Println("cannot create SOCKS server:", err)
 			return
 		}
 
-		listener, err := net.Listen(network, "localhost:0")
+		listener, err := net.Listen(t.network, "localhost:0")
 		if err != nil {
-			errorLogger.Println("cannot create SOCKS listener:", err)
+			t.errorLogger.Println("cannot create SOCKS listener:", err)
 			return
 		}
 		_, port, err := net.SplitHostPort(listener.Addr().String())
 		if err != nil {
-			errorLogger.Println("cannot retrieve SOCKS port:", err)
+			t.errorLogger.Println("cannot retrieve SOCKS port:", err)
 			return
 		}
 		t.sendControl("SOCKS-AT:" + port)
 		if err := server.Serve(listener); err != nil {
-			errorLogger.Println("cannot start SOCKS server:", err)
+			t.errorLogger.Println("cannot start SOCKS server:", err)
 			return
 		}
 	}()
@@ -116,35 +179,35 @@ func (t *Tunnel) startSOCKSServer() {
 
 func (t *Tunnel) handleChannels(chans <-chan ssh.NewChannel) {
 	for newChannel := range chans {
-		go handleChannel(newChannel)
+		go t.handleChannel(newChannel)
 	}
 }
 
-func handleSession(newChannel ssh.NewChannel) {
+func (c *Tunnel) handleSession(newChannel ssh.NewChannel) {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
-		errorLogger.Printf("Could not accept channel: %s\n", err)
+		c.errorLogger.Printf("Could not accept channel: %s\n", err)
 		return
 	}
 
 	go func(in <-chan *ssh.Request) {
 		defer channel.Close()
 		for req := range in {
-			debugLogger.Println("session request type:", req.Type, "payload:", string(req.Payload), "want reply:", req.WantReply)
+			c.debugLogger.Println("session request type:", req.Type, "payload:", string(req.Payload), "want reply:", req.WantReply)
 			if req.Type == "subsystem" && len(req.Payload) >= 4 &&
 				string(req.Payload[4:]) == "sftp" {
-				debugLogger.Printf("request for '%s %s' accepted",
+				c.debugLogger.Printf("request for '%s %s' accepted",
 					req.Type, req.Payload)
 				req.Reply(true, nil)
 			} else if req.Type == "exec" {
 				var payload = struct{ Value string }{}
 				ssh.Unmarshal(req.Payload, &payload)
-				debugLogger.Printf("request for '%s %s' accepted",
+				c.debugLogger.Printf("request for '%s %s' accepted",
 					req.Type, payload.Value)
 
 				args, err := shellwords.Parse(payload.Value)
 				if err != nil {
-					errorLogger.Println("cannot parse command:", err)
+					c.errorLogger.Println("cannot parse command:", err)
 					return
 				}
 				var cmd *exec.Cmd
@@ -156,22 +219,22 @@ func handleSession(newChannel ssh.NewChannel) {
 
 				stdout, err := cmd.StdoutPipe()
 				if err != nil {
-					errorLogger.Println("cannot connect stdout:", err)
+					c.errorLogger.Println("cannot connect stdout:", err)
 					return
 				}
 				stderr, err := cmd.StderrPipe()
 				if err != nil {
-					errorLogger.Println("cannot connect stderr:", err)
+					c.errorLogger.Println("cannot connect stderr:", err)
 					return
 				}
 				input, err := cmd.StdinPipe()
 				if err != nil {
-					errorLogger.Println("cannot connect stdin:", err)
+					c.errorLogger.Println("cannot connect stdin:", err)
 					return
 				}
 
 				if err = cmd.Start(); err != nil {
-					errorLogger.Println("cannot start command:", err)
+					c.errorLogger.Println("cannot start command:", err)
 					return
 				}
 
@@ -180,7 +243,7 @@ func handleSession(newChannel ssh.NewChannel) {
 				io.Copy(channel.Stderr(), stderr)
 
 				if err = cmd.Wait(); err != nil {
-					log.Println("error waiting for command:", err)
+					c.errorLogger.Println("error waiting for command:", err)
 					return
 				}
 				channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
@@ -197,48 +260,49 @@ func handleSession(newChannel ssh.NewChannel) {
 		serverOptions...,
 	)
 	if err != nil {
-		errorLogger.Fatalln("cannot create sftp server:", err)
+		c.errorLogger.Println("cannot create sftp server:", err)
+		return
 	}
 	if err := server.Serve(); err == io.EOF {
 		server.Close()
-		debugLogger.Println("sftp client closed session")
+		c.debugLogger.Println("sftp client closed session")
 	} else if err != nil {
-		errorLogger.Println("sftp server stopped:", err)
+		c.errorLogger.Println("sftp server stopped:", err)
 	}
 
 }
 
-func handleChannel(newChannel ssh.NewChannel) {
-	debugLogger.Println("received channel:", newChannel.ChannelType())
+func (c *Tunnel) handleChannel(newChannel ssh.NewChannel) {
+	c.debugLogger.Println("received channel:", newChannel.ChannelType())
 	t := newChannel.ChannelType()
 	if t == "session" {
-		handleSession(newChannel)
+		c.handleSession(newChannel)
 		return
 	}
 	if t != "direct-tcpip" {
-		errorLogger.Println("received unknown channel type:", t)
+		c.errorLogger.Println("received unknown channel type:", t)
 		newChannel.Reject(ssh.UnknownChannelType, "unknown channel type: "+t)
 		return
 	}
 
 	connection, _, err := newChannel.Accept()
 	if err != nil {
-		errorLogger.Println("cannot not accept channel:", err)
+		c.errorLogger.Println("cannot not accept channel:", err)
 		return
 	}
 	if connection != nil {
 		r := newChannel.ExtraData()
 		var cmsg channelOpenDirectMsg
 		if err := ssh.Unmarshal(r, &cmsg); err != nil {
-			errorLogger.Println("cannot unmarshal OpenDirectMsg data:", err)
+			c.errorLogger.Println("cannot unmarshal OpenDirectMsg data:", err)
 			return
 		}
-		debugLogger.Printf("received connection forward request: %s:%d => %s:%d\n",
+		c.debugLogger.Printf("received connection forward request: %s:%d => %s:%d\n",
 			cmsg.Laddr, cmsg.Lport, cmsg.Raddr, cmsg.Rport)
 
-		targetConn, err := net.Dial(network, fmt.Sprintf("%s:%d", cmsg.Raddr, cmsg.Rport))
+		targetConn, err := net.Dial(c.network, net.JoinHostPort(cmsg.Raddr, strconv.Itoa(int(cmsg.Rport))))
 		if err != nil {
-			errorLogger.Println("cannot create forwarding connection:", err)
+			c.errorLogger.Println("cannot create forwarding connection:", err)
 			return
 		}
 		go func() {
@@ -253,12 +317,20 @@ func handleChannel(newChannel ssh.NewChannel) {
 }
 
 func (t *Tunnel) handleRequests(in <-chan *ssh.Request, conn *ssh.ServerConn) {
+	var listeners []net.Listener
 	for req := range in {
-		t.handleRequest(req, conn)
+		if ln := t.handleRequest(req, conn); ln != nil {
+			listeners = append(listeners, ln)
+		}
+	}
+	// the ssh connection is gone, the client requests its remote
+	// forwardings again once it established a new one
+	for _, ln := range listeners {
+		ln.Close()
 	}
 }
 
-func (t *Tunnel) handleRequest(req *ssh.Request, conn *ssh.ServerConn) {
+func (t *Tunnel) handleRequest(req *ssh.Request, conn *ssh.ServerConn) net.Listener {
 	if req.Type != "tcpip-forward" {
 		if req.WantReply {
 			req.Reply(false, []byte{})
@@ -266,18 +338,18 @@ func (t *Tunnel) handleRequest(req *ssh.Request, conn *ssh.ServerConn) {
 	}
 	var msg tcpIpForwardPayload
 	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
-		errorLogger.Println("cannot unmarshal IpForwardPayload data:", err)
-		return
+		t.errorLogger.Println("cannot unmarshal IpForwardPayload data:", err)
+		return nil
 	}
-	debugLogger.Printf("received connection forward request: %s:%d\n",
+	t.debugLogger.Printf("received connection forward request: %s:%d\n",
 		msg.Addr, msg.Port)
 
 	bind := fmt.Sprintf("[%s]:%d", msg.Addr, msg.Port)
-	debugLogger.Printf("listening on '%s' for incoming connections for remote forwarding\n", bind)
-	ln, err := net.Listen(network, bind)
+	t.debugLogger.Printf("listening on '%s' for incoming connections for remote forwarding\n", bind)
+	ln, err := net.Listen(t.network, bind)
 	if err != nil {
-		errorLogger.Println("network listen failed:", err)
-		return
+		t.errorLogger.Println("network listen failed:", err)
+		return nil
 	}
 
 	reply := tcpIpForwardReplyPayload{msg.Port}
@@ -286,15 +358,15 @@ func (t *Tunnel) handleRequest(req *ssh.Request, conn *ssh.ServerConn) {
 	go func() {
 		for {
 			lconn, err := ln.Accept()
-			debugLogger.Println("accepted connection for remote forwarding on", bind)
+			t.debugLogger.Println("accepted connection for remote forwarding on", bind)
 			if err != nil {
 				neterr := err.(net.Error)
 				if neterr.Timeout() {
-					errorLogger.Printf("accept failed with timeout: %s\n", err)
+					t.errorLogger.Printf("accept failed with timeout: %s\n", err)
 					continue
 				}
 				if neterr.Temporary() {
-					errorLogger.Printf("accept failed temporary: %s\n", err)
+					t.errorLogger.Printf("accept failed temporary: %s\n", err)
 					continue
 				}
 				break
@@ -310,23 +382,24 @@ func (t *Tunnel) handleRequest(req *ssh.Request, conn *ssh.ServerConn) {
 
 				c, requests, err := conn.OpenChannel("forwarded-tcpip", mpayload)
 				if err != nil {
-					errorLogger.Println("cannot open channel:", err)
+					t.errorLogger.Println("cannot open channel:", err)
 					lconn.Close()
 					return
 				}
 				go ssh.DiscardRequests(requests)
 
-				serve(c, lconn)
+				t.serve(c, lconn)
 			}(lconn, msg.Addr, msg.Port)
 		}
 	}()
+	return ln
 }
 
-func serve(ch io.ReadWriteCloser, conn io.ReadWriteCloser) {
+func (c *Tunnel) serve(ch io.ReadWriteCloser, conn io.ReadWriteCloser) {
 	go func() {
 		_, err := io.Copy(ch, conn)
 		if err != nil {
-			errorLogger.Println("io.Copy failed:", err)
+			c.errorLogger.Println("io.Copy failed:", err)
 		}
 		ch.Close()
 	}()
@@ -334,37 +407,39 @@ func serve(ch io.ReadWriteCloser, conn io.ReadWriteCloser) {
 	go func() {
 		_, err := io.Copy(conn, ch)
 		if err != nil {
-			errorLogger.Println("io.Copy failed:", err)
+			c.errorLogger.Println("io.Copy failed:", err)
 		}
 		conn.Close()
 	}()
 
 }
 
-func (t *Tunnel) StartClient() {
-	s, err := net.Listen(network, "localhost:0")
-	if err != nil {
-		errorLogger.Fatalln("cannot open listener:", err)
+// newSSHConn replaces the connection carrying the internal ssh connection.
+// Data of the previous connection not read yet is discarded.
+func (t *Tunnel) newSSHConn() *sshConn {
+	conn := &sshConn{Channel: t.Channel, closed: make(chan struct{})}
+	t.mutex.Lock()
+	previous := t.conn
+	t.conn = conn
+	t.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
 	}
-	listenAddr := s.Addr().String()
-
-	go func() {
-		defer s.Close()
-		conn, _ := s.Accept()
-		for {
-			data, err := GetConnData(conn, t.bufferSize, t.interval*4/5)
-			if err != nil {
-				t.CloseChannel()
-			} else {
-				t.Send(data)
-			}
-			cbdata := t.Receive()
-			conn.Write([]byte(cbdata))
+	t.discardReadBuffer()
+	return conn
+}
 
-		}
-	}()
-	debugLogger.Printf("listening for internal ssh traffic on %s\n", listenAddr)
+// StartClient establishes the internal ssh connection to the server.
+func (t *Tunnel) StartClient() error {
+	if err := t.dialSSH(t.newSSHConn()); err != nil {
+		return fmt.Errorf("cannot establish ssh connection: %s", err)
+	}
+	t.debugLogger.Println("ssh connection established")
+	return nil
+}
 
+// dialSSH establishes the internal ssh connection to the server.
+func (t *Tunnel) dialSSH(conn *sshConn) error {
 	config := &ssh.ClientConfig{
 		User: "cliptun",
 		Auth: []ssh.AuthMethod{
@@ -373,23 +448,62 @@ func (t *Tunnel) StartClient() {
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	t.sshClientConn, err = ssh.Dial(network, listenAddr, config)
+	c, chans, reqs, err := ssh.NewClientConn(conn, t.RemoteAddr().String(), config)
 	if err != nil {
-		errorLogger.Fatalln("ssh.Dial failed:", err)
+		conn.Close()
+		return err
 	}
-	debugLogger.Println("ssh connection established")
+	client := ssh.NewClient(c, chans, reqs)
+	t.mutex.Lock()
+	previous := t.sshClientConn
+	t.sshClientConn = client
+	t.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+func (t *Tunnel) sshClient() *ssh.Client {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.sshClientConn
+}
+
+// resumeClient establishes the internal ssh connection again after the
+// server resumed the session, along with the remote forwardings and the
+// SOCKS server. Connections forwarded before are lost.
+func (t *Tunnel) resumeClient() {
+	conn := t.newSSHConn()
+	go func() {
+		if err := t.dialSSH(conn); err != nil {
+			t.errorLogger.Println("cannot establish ssh connection again:", err)
+			return
+		}
+		t.debugLogger.Println("ssh connection established again")
+		t.mutex.Lock()
+		forwardings := append([]PortForwarding{}, t.remoteForwardings...)
+		socks := t.socksListenPort > 0
+		t.mutex.Unlock()
+		for _, fwd := range forwardings {
+			t.listenRemote(fwd)
+		}
+		if socks {
+			t.sendControl("START-SOCKS")
+		}
+	}()
 }
 
 func (t *Tunnel) StartSftp() *sftp.Client {
-	client, err := sftp.NewClient(t.sshClientConn)
+	client, err := sftp.NewClient(t.sshClient())
 	if err != nil {
-		errorLogger.Println("failed to create sftp client:", err)
+		t.errorLogger.Println("failed to create sftp client:", err)
 	}
 	return client
 }
 
 func (t *Tunnel) ExecuteCommand(cmd string) (output string, err error) {
-	s, err := t.sshClientConn.NewSession()
+	s, err := t.sshClient().NewSession()
 	if err != nil {
 		return "", err
 	}
@@ -402,27 +516,8 @@ func (t *Tunnel) ExecuteCommand(cmd string) (output string, err error) {
 	return string(out), nil
 }
 
-func (t *Tunnel) StartServer() {
-	addr := t.startSSHServer()
-
-	conn, err := net.Dial(network, addr)
-	if err != nil {
-		errorLogger.Fatalln("cannot create connection to local SSH server:", err)
-	}
-
-	for {
-		cbdata := t.Receive()
-		conn.Write(cbdata)
-		data, err := GetConnData(conn, t.bufferSize, t.interval*4/5)
-		if err != nil {
-			t.CloseChannel()
-		} else {
-			t.Send(data)
-		}
-	}
-}
-
-func (t *Tunnel) startSSHServer() string {
+// StartServer runs the internal ssh server until the channel is closed.
+func (t *Tunnel) StartServer() error {
 	config := &ssh.ServerConfig{
 		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
 			if c.User() == "cliptun" && string(pass) == "cliptun" {
@@ -434,103 +529,117 @@ func (t *Tunnel) startSSHServer() string {
 
 	rsaPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
-		errorLogger.Fatalln("failed to generate rsa private key")
+		return fmt.Errorf("failed to generate rsa private key: %s", err)
 	}
 
 	sshPrivateKey, err := ssh.NewSignerFromKey(rsaPrivateKey)
 	if err != nil {
-		errorLogger.Fatalln("failed to create ssh private key from rsa private key")
+		return fmt.Errorf("failed to create ssh private key from rsa private key: %s", err)
 	}
 
 	config.AddHostKey(sshPrivateKey)
+	t.sshConfig = config
 
-	listener, err := net.Listen(network, "localhost:0")
-	if err != nil {
-		errorLogger.Fatalf("failed to create listener on localhost")
-	}
-
-	listenAddr := listener.Addr().String()
-	debugLogger.Println("started internal SSH server on:", listenAddr)
+	t.debugLogger.Println("started internal SSH server")
+	t.serveSSH(t.newSSHConn())
+	<-t.Done()
+	return t.Err()
+}
 
+// serveSSH runs the internal ssh server on the given connection.
+func (t *Tunnel) serveSSH(conn *sshConn) {
 	go func() {
-		conn, err := listener.Accept()
+		shConn, chans, reqs, err := ssh.NewServerConn(conn, t.sshConfig)
 		if err != nil {
-			errorLogger.Fatalln("Failed to accept incoming connection for internal SSH server:", err)
-			return
-		}
-
-		shConn, chans, reqs, err := ssh.NewServerConn(conn, config)
-		if err != nil {
-			errorLogger.Fatalln("failed to create SSH server connection:", err)
+			t.errorLogger.Println("failed to create SSH server connection:", err)
 			return
 		}
 
 		go t.handleRequests(reqs, shConn)
 		go t.handleChannels(chans)
 	}()
+}
 
-	return listenAddr
+// resumeServer starts the internal ssh server again after the client
+// resumed the session, as the client establishes a new ssh connection.
+func (t *Tunnel) resumeServer() {
+	t.serveSSH(t.newSSHConn())
 }
 
 func (c *Tunnel) transfer(localConn net.Conn, target string) {
-	sshConn, err := net.Dial("tcp4", target)
+	sshConn, err := net.Dial(c.network, target)
 	if err != nil {
-		errorLogger.Printf("cannot dial for target '%s': %s\n", target, err)
+		c.errorLogger.Printf("cannot dial for target '%s': %s\n", target, err)
 		return
 	}
-	debugLogger.Printf("connection transferred to '%s'\n", target)
+	c.debugLogger.Printf("connection transferred to '%s'\n", target)
 
-	go serve(sshConn, localConn)
+	go c.serve(sshConn, localConn)
 }
 
 func (c *Tunnel) forward(localConn net.Conn, target string) {
-	sshConn, err := c.sshClientConn.Dial("tcp4", target)
+	sshConn, err := c.sshClient().Dial(c.network, target)
 	if err != nil {
-		errorLogger.Printf("cannot dial for taget '%s': %s\n", target, err)
+		c.errorLogger.Printf("cannot dial for taget '%s': %s\n", target, err)
 		return
 	}
-	debugLogger.Printf("connection forwarded to '%s'\n", target)
+	c.debugLogger.Printf("connection forwarded to '%s'\n", target)
 
-	go serve(sshConn, localConn)
+	go c.serve(sshConn, localConn)
 }
 
 func (c *Tunnel) AddLocalPortForwarding(fwd PortForwarding) {
-	go func(fwd PortForwarding) {
-		debugLogger.Printf("trying to establish local port fowarding from '%s' to '%s'\n", fwd.Port, fwd.Host+":"+fwd.HostPort)
-		localListener, err := net.Listen(network, "localhost:"+fwd.Port)
+	c.listenLocal(fwd.Port, func() string { return fwd.Host + ":" + fwd.HostPort })
+}
+
+// listenLocal forwards connections to the local port to the target
+// returned by the given function.
+func (c *Tunnel) listenLocal(port string, target func() string) {
+	go func() {
+		c.debugLogger.Printf("trying to establish local port fowarding from '%s' to '%s'\n", port, target())
+		localListener, err := net.Listen(c.network, "localhost:"+port)
 		if err != nil {
-			errorLogger.Printf("net.Listen failed for local port forwarding: %s", err)
+			c.errorLogger.Printf("net.Listen failed for local port forwarding: %s", err)
 			return
 		}
 		for {
-			debugLogger.Println("listening for local connections to forward on", localListener.Addr().String())
+			c.debugLogger.Println("listening for local connections to forward on", localListener.Addr().String())
 			localConn, err := localListener.Accept()
 			if err != nil {
-				errorLogger.Println("listen.Accept failed:", err)
+				c.errorLogger.Println("listen.Accept failed:", err)
 				continue
 			}
-			debugLogger.Println("connection accepted on local listener, forwarding...")
-			go c.forward(localConn, fwd.Host+":"+fwd.HostPort)
+			c.debugLogger.Println("connection accepted on local listener, forwarding...")
+			go c.forward(localConn, target())
 		}
-	}(fwd)
+	}()
 }
 
 func (c *Tunnel) AddRemotePortForwarding(fwd PortForwarding) {
+	c.mutex.Lock()
+	c.remoteForwardings = append(c.remoteForwardings, fwd)
+	c.mutex.Unlock()
+	c.listenRemote(fwd)
+}
+
+// listenRemote asks the server to listen on the remote port of the
+// forwarding, until the ssh connection is gone.
+func (c *Tunnel) listenRemote(fwd PortForwarding) {
 	go func(fwd PortForwarding) {
-		debugLogger.Printf("trying to listen on port '%s' for remote conns to '%s'\n", fwd.Port, fwd.Host+":"+fwd.HostPort)
-		remoteListener, err := c.sshClientConn.Listen(network, "localhost:"+fwd.Port)
+		c.debugLogger.Printf("trying to listen on port '%s' for remote conns to '%s'\n", fwd.Port, fwd.Host+":"+fwd.HostPort)
+		remoteListener, err := c.sshClient().Listen(c.network, "localhost:"+fwd.Port)
 		if err != nil {
-			errorLogger.Printf("net.Listen failed for remote port forwarding: %s", err)
+			c.errorLogger.Printf("net.Listen failed for remote port forwarding: %s", err)
 			return
 		}
 		for {
-			debugLogger.Println("listening for remote conns to forward on", remoteListener.Addr().String())
+			c.debugLogger.Println("listening for remote conns to forward on", remoteListener.Addr().String())
 			remoteConn, err := remoteListener.Accept()
 			if err != nil {
-				errorLogger.Println("listen.Accept failed:", err)
-				continue
+				c.debugLogger.Println("remote listener closed:", err)
+				return
 			}
-			debugLogger.Println("connection accepted on remote listener, forwarding...")
+			c.debugLogger.Println("connection accepted on remote listener, forwarding...")
 			go c.transfer(remoteConn, fwd.Host+":"+fwd.HostPort)
 		}
 	}(fwd)
@@ -0,0 +1,46 @@
+package channel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTransferNetwork(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for _, network := range []string{"tcp4", "tcp", "tcp6"} {
+		c := testChannel(CLIENT, "")
+		c.debugLogger = newLevelLogger(nil, LevelDebug)
+		c.errorLogger = newLevelLogger(nil, LevelError)
+		tunnel := &Tunnel{Channel: c, network: network}
+		local, remote := net.Pipe()
+		tunnel.transfer(remote, listener.Addr().String())
+		select {
+		case conn := <-accepted:
+			if network == "tcp6" {
+				t.Errorf("%s: connected to an IPv4 address", network)
+			}
+			conn.Close()
+		case <-time.After(time.Second):
+			if network != "tcp6" {
+				t.Errorf("%s: no connection to the target", network)
+			}
+		}
+		local.Close()
+	}
+}
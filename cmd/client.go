@@ -43,7 +43,11 @@ var clientCmd = &cobra.Command{
 			remotePortForwardings = append(remotePortForwardings, *portfwd)
 		}
 
-		tunnel.StartClient()
+		handleInterrupt(tunnel.Channel)
+		go exitOnClose(tunnel.Channel)
+		if err := tunnel.StartClient(); err != nil {
+			errorLogger.Fatalln(err)
+		}
 
 		socksPort, _ := cmd.Flags().GetInt("socks")
 		if socksPort > 0 {
@@ -66,5 +70,6 @@ func init() {
 	clientCmd.Flags().StringSlice("fwd-local", []string{}, "forward local port to remote host and port (LPORT:RHOST:RPORT)")
 	clientCmd.Flags().StringSlice("fwd-remote", []string{}, "forward remote port to local host and port (RPORT:LHOST:LPORT)")
 	clientCmd.Flags().Int("socks", 0, "start SOCKS5 server on the given port")
+	addPeerFlag(clientCmd)
 	rootCmd.AddCommand(clientCmd)
 }
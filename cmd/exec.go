@@ -22,6 +22,9 @@ var execCmd = &cobra.Command{
 		if err != nil {
 			errorLogger.Fatalln("Cannot create channel:", err)
 		}
+		reportConnection(channel)
+		reportStats(cmd, channel)
+		handleInterrupt(channel)
 
 		if len(args) == 0 || len(args[0]) == 0 {
 			errorLogger.Fatalln("no command given")
@@ -53,26 +56,32 @@ var execCmd = &cobra.Command{
 				} else {
 					debugLogger.Printf("Program '%s' terminated with error: %s\n", commandline, cmdErr)
 				}
-				channel.CloseChannel()
+				go channel.Close()
 			default:
 			}
-			cbdata := channel.Receive()
+			cbdata, err := channel.Receive()
+			if err != nil {
+				break
+			}
 			if len(cbdata) == 0 {
 				continue
 			}
 			debugLogger.Println("got data:", string(cbdata))
 			stdin.Write(cbdata)
-			data := make([]byte, options.Blocksize)
+			data := make([]byte, channel.Blocksize())
 			length, err := stdoutNB.Read(data)
 			if err == io.EOF {
 				debugLogger.Printf("Program '%s' terminated.\n", commandline)
-				channel.CloseChannel()
+				go channel.Close()
 			}
 			channel.Send(data[0:length])
 		}
+		exitOnClose(channel)
 	},
 }
 
 func init() {
+	addStatsIntervalFlag(execCmd)
+	addNameFlag(execCmd)
 	rootCmd.AddCommand(execCmd)
 }
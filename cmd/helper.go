@@ -1,38 +1,364 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/svent/cliptun/channel"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func getChannelOptions(cmd *cobra.Command) (channel.ChannelOptions, error) {
 	// basic flag parsing errors will be handled by cobra
 	interval, _ := cmd.Flags().GetDuration("interval")
-	password, _ := cmd.Flags().GetString("password")
+	pairing, _ := cmd.Flags().GetBool("pair")
 	transport, _ := cmd.Flags().GetString("transport")
+	window, _ := cmd.Flags().GetInt("window")
 	bs, _ := cmd.Flags().GetString("blocksize")
 	blocksize, err := parseBlocksize(bs)
 	if err != nil {
 		return channel.ChannelOptions{}, fmt.Errorf("cannot parse blocksize: %s", err)
 	}
+	autoTune, _ := cmd.Flags().GetBool("auto-tune")
+	probeBlocksize, _ := cmd.Flags().GetBool("probe-blocksize")
+	peerTimeout, _ := cmd.Flags().GetDuration("peer-timeout")
+	keepalive, _ := cmd.Flags().GetDuration("keepalive")
+	sessionFile, _ := cmd.Flags().GetString("session-file")
+	minInterval, _ := cmd.Flags().GetDuration("min-interval")
+	maxInterval, _ := cmd.Flags().GetDuration("max-interval")
+	var minBlocksize, maxBlocksize int
+	if bs, _ := cmd.Flags().GetString("min-blocksize"); bs != "" {
+		if minBlocksize, err = parseBlocksize(bs); err != nil {
+			return channel.ChannelOptions{}, fmt.Errorf("cannot parse min-blocksize: %s", err)
+		}
+	}
+	if bs, _ := cmd.Flags().GetString("max-blocksize"); bs != "" {
+		if maxBlocksize, err = parseBlocksize(bs); err != nil {
+			return channel.ChannelOptions{}, fmt.Errorf("cannot parse max-blocksize: %s", err)
+		}
+	}
+	rekeyPackets, _ := cmd.Flags().GetInt64("rekey-packets")
+	rekeyInterval, _ := cmd.Flags().GetDuration("rekey-interval")
+	rb, _ := cmd.Flags().GetString("rekey-bytes")
+	rekeyBytes, err := parseBlocksize(rb)
+	if err != nil {
+		return channel.ChannelOptions{}, fmt.Errorf("cannot parse rekey-bytes: %s", err)
+	}
+	kdf, _ := cmd.Flags().GetString("kdf")
+	compression, _ := cmd.Flags().GetString("compression")
+	streamCompression, _ := cmd.Flags().GetBool("stream-compression")
+	encoding, _ := cmd.Flags().GetString("encoding")
+	wrap, _ := cmd.Flags().GetInt("wrap")
+	fec, _ := cmd.Flags().GetFloat64("fec")
+	broadcast, _ := cmd.Flags().GetBool("broadcast")
+	broadcastRepeat, _ := cmd.Flags().GetInt("broadcast-repeat")
+	// the server's name is given by --name on its side, and by --peer on
+	// the client's side
+	name, _ := cmd.Flags().GetString("name")
+	if peer, _ := cmd.Flags().GetString("peer"); peer != "" {
+		name = peer
+	}
+	var key []byte
+	var password string
+	if keyFile, _ := cmd.Flags().GetString("key-file"); keyFile != "" {
+		if key, err = loadKeyFile(keyFile); err != nil {
+			return channel.ChannelOptions{}, err
+		}
+	} else if password, err = getPassword(cmd); err != nil {
+		return channel.ChannelOptions{}, err
+	}
 	options := channel.ChannelOptions{
-		Interval:    interval,
-		Password:    password,
-		Transport:   transport,
-		Blocksize:   blocksize,
-		ErrorLogger: errorLogger,
-		DebugLogger: debugLogger,
-		TraceLogger: traceLogger,
+		Interval:          interval,
+		Password:          password,
+		KDF:               kdf,
+		Key:               key,
+		Pairing:           pairing,
+		Transport:         transport,
+		Blocksize:         blocksize,
+		Window:            window,
+		AutoTune:          autoTune,
+		MinInterval:       minInterval,
+		MaxInterval:       maxInterval,
+		MinBlocksize:      minBlocksize,
+		MaxBlocksize:      maxBlocksize,
+		ProbeBlocksize:    probeBlocksize,
+		Compression:       compression,
+		StreamCompression: streamCompression,
+		Encoding:          encoding,
+		Wrap:              wrap,
+		FECRatio:          fec,
+		RekeyPackets:      rekeyPackets,
+		RekeyBytes:        int64(rekeyBytes),
+		RekeyInterval:     rekeyInterval,
+		PeerTimeout:       peerTimeout,
+		KeepaliveInterval: keepalive,
+		SessionFile:       sessionFile,
+		Broadcast:         broadcast,
+		BroadcastRepeat:   broadcastRepeat,
+		Name:              name,
+		Logger:            channel.NewLogger(os.Stderr, "", logLevel),
+	}
+	if pairing {
+		options.PairingCallback = confirmPairingCode
 	}
 	return options, nil
 }
 
+// getPassword returns the password from the source selected on the command
+// line. The built-in default password is only used in pairing mode (where
+// the password is not relied upon) or if explicitly requested.
+func getPassword(cmd *cobra.Command) (string, error) {
+	pairing, _ := cmd.Flags().GetBool("pair")
+	insecure, _ := cmd.Flags().GetBool("insecure-default-password")
+
+	var sources []string
+	for _, name := range []string{"password", "password-env", "password-file", "password-fd", "ask-password"} {
+		if cmd.Flags().Changed(name) {
+			sources = append(sources, "--"+name)
+		}
+	}
+	if len(sources) > 1 {
+		return "", fmt.Errorf("conflicting password options: %s", strings.Join(sources, ", "))
+	}
+
+	var password string
+	switch {
+	case cmd.Flags().Changed("password"):
+		password, _ = cmd.Flags().GetString("password")
+	case cmd.Flags().Changed("password-env"):
+		name, _ := cmd.Flags().GetString("password-env")
+		var ok bool
+		if password, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	case cmd.Flags().Changed("password-file"):
+		name, _ := cmd.Flags().GetString("password-file")
+		f, err := os.Open(name)
+		if err != nil {
+			return "", fmt.Errorf("cannot open password file: %s", err)
+		}
+		defer f.Close()
+		if password, err = readPasswordLine(f); err != nil {
+			return "", fmt.Errorf("cannot read password file: %s", err)
+		}
+	case cmd.Flags().Changed("password-fd"):
+		fd, _ := cmd.Flags().GetInt("password-fd")
+		if fd == 0 {
+			// reading the line buffered would consume the data following it
+			return "", fmt.Errorf("cannot read password from stdin, use another file descriptor (e.g. --password-fd 3 3<file)")
+		}
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+		if f == nil {
+			return "", fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		// the descriptor is not ours, so it is left open (and the file kept
+		// referenced, as it would be closed once garbage collected)
+		passwordFile = f
+		var err error
+		if password, err = readPasswordLine(f); err != nil {
+			return "", fmt.Errorf("cannot read password from file descriptor %d: %s", fd, err)
+		}
+	case cmd.Flags().Changed("ask-password"):
+		var err error
+		if password, err = askPassword(); err != nil {
+			return "", err
+		}
+	default:
+		name, _ := cmd.Flags().GetString("password-env")
+		if env, ok := os.LookupEnv(name); ok {
+			password = env
+			break
+		}
+		if !pairing && !insecure {
+			return "", fmt.Errorf("no password given, use --password-env, --password-file, --password-fd, --ask-password or --key-file (or --insecure-default-password to use the built-in default)")
+		}
+		if !pairing {
+			infoLogger.Println("Warning: using the built-in default password, the tunnel is not protected")
+		}
+		return defaultPassword, nil
+	}
+	if password == "" {
+		return "", fmt.Errorf("empty password given")
+	}
+	if password == defaultPassword && !pairing && !insecure {
+		return "", fmt.Errorf("refusing to use the built-in default password without --insecure-default-password")
+	}
+	return password, nil
+}
+
+// passwordFile is the file given by --password-fd, see getPassword.
+var passwordFile *os.File
+
+// readPasswordLine reads the first line of a password file.
+func readPasswordLine(f *os.File) (string, error) {
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// askPassword prompts for the password on the terminal, without echoing
+// the input.
+func askPassword() (string, error) {
+	tty, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("cannot open terminal to ask for password: %s", err)
+	}
+	defer tty.Close()
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("cannot read password: %s", err)
+	}
+	return string(password), nil
+}
+
+// loadKeyFile reads a 32 byte key, stored either as raw bytes or encoded
+// as hex or base64.
+func loadKeyFile(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key file: %s", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(text); err == nil && len(key) == 32 {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("key file must contain a 32 byte key (raw, hex or base64 encoded)")
+}
+
+// openTerminal opens the terminal for interacting with the user, as STDIN
+// may be used for tunneled data.
+func openTerminal() (*os.File, error) {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONIN$"
+	}
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
+
+// confirmPairingCode shows the pairing code and asks the user to compare
+// it to the code shown on the other side.
+func confirmPairingCode(code string) bool {
+	infoLogger.Println("pairing code:", code)
+	tty, err := openTerminal()
+	if err != nil {
+		errorLogger.Println("cannot open terminal to confirm pairing code:", err)
+		return false
+	}
+	defer tty.Close()
+	fmt.Fprint(os.Stderr, "Does it match the code shown on the other side? [y/N] ")
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// reportConnection prints a message as soon as the peer is connected.
+func reportConnection(c *channel.Channel) {
+	go func() {
+		<-c.Connected()
+		infoLogger.Println("peer connected")
+	}()
+}
+
+// addStatsIntervalFlag adds the option for printing the link statistics
+// periodically.
+func addStatsIntervalFlag(cmd *cobra.Command) {
+	cmd.Flags().Duration("stats-interval", 0, "print a summary of the link statistics to stderr at this interval")
+}
+
+// addBroadcastFlags adds the options for broadcast mode, which is only
+// supported by stdin and stdout.
+func addBroadcastFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("broadcast", false, "send data in one direction only, without waiting for the peer (for links that work one way)")
+	cmd.Flags().Int("broadcast-repeat", 3, "number of times each packet is sent in broadcast mode")
+}
+
+// addNameFlag adds the option for naming a server, so several pairs can
+// share the clipboard.
+func addNameFlag(cmd *cobra.Command) {
+	cmd.Flags().String("name", "", "name of this server, so several pairs can share the clipboard (the client selects it using --peer)")
+}
+
+// addPeerFlag adds the option for selecting the server to connect to.
+func addPeerFlag(cmd *cobra.Command) {
+	cmd.Flags().String("peer", "", "name of the peer to connect to (see --name)")
+}
+
+// reportStats prints a summary of the link statistics at the interval
+// given by --stats-interval, until the channel is closed.
+func reportStats(cmd *cobra.Command, c *channel.Channel) {
+	interval, _ := cmd.Flags().GetDuration("stats-interval")
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				infoLogger.Println("stats:", c.Stats())
+			case <-c.Done():
+				return
+			}
+		}
+	}()
+}
+
+// handleInterrupt suspends the channel on the first interrupt, so the
+// session can be resumed with a session file, and the peer is told right
+// away instead of after the data queued otherwise (see Suspend). It exits
+// immediately on the second one.
+func handleInterrupt(c *channel.Channel) {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, os.Interrupt)
+	go func() {
+		force := false
+		for range sigChannel {
+			if force {
+				os.Exit(130)
+			}
+			force = true
+			go c.Suspend()
+		}
+	}()
+}
+
+// exitOnClose waits until the channel has been closed and exits, with an
+// error if the channel stopped due to one.
+func exitOnClose(c *channel.Channel) {
+	<-c.Done()
+	if err := c.Err(); err != nil {
+		errorLogger.Fatalln(err)
+	}
+	os.Exit(0)
+}
+
 func parseBlocksize(arg string) (int, error) {
-	re := regexp.MustCompile(`^\d+[kKmM]?$`)
+	re := regexp.MustCompile(`^\d+[kKmMgG]?$`)
 	if !re.MatchString(arg) {
 		return 0, fmt.Errorf("unknown blocksize format '%s'", arg)
 	}
@@ -44,6 +370,9 @@ func parseBlocksize(arg string) (int, error) {
 	case "m", "M":
 		blocksize, _ = strconv.Atoi(arg[0 : len(arg)-1])
 		return blocksize * 1024 * 1024, nil
+	case "g", "G":
+		blocksize, _ = strconv.Atoi(arg[0 : len(arg)-1])
+		return blocksize * 1024 * 1024 * 1024, nil
 	default:
 		blocksize, _ := strconv.Atoi(arg)
 		return blocksize, nil
@@ -21,6 +21,8 @@ var readlineCmd = &cobra.Command{
 		if err != nil {
 			errorLogger.Fatalln("Cannot create channel:", err)
 		}
+		reportConnection(channel)
+		handleInterrupt(channel)
 
 		lineChan := make(chan string)
 		go func(lineChan chan string) {
@@ -40,12 +42,17 @@ var readlineCmd = &cobra.Command{
 			default:
 				channel.Send([]byte{})
 			}
-			cbdata := channel.Receive()
+			cbdata, err := channel.Receive()
+			if err != nil {
+				break
+			}
 			os.Stdout.Write([]byte(cbdata))
 		}
+		exitOnClose(channel)
 	},
 }
 
 func init() {
+	addPeerFlag(readlineCmd)
 	rootCmd.AddCommand(readlineCmd)
 }
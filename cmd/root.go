@@ -4,15 +4,21 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/svent/cliptun/channel"
 )
 
+const defaultPassword = "cliptun"
+
 var (
 	errorLogger = log.New(os.Stderr, "Error: ", 0)
+	infoLogger  = log.New(os.Stderr, "", 0)
 	debugLogger = log.New(ioutil.Discard, "", 0)
-	traceLogger = log.New(ioutil.Discard, "", 0)
+	// logLevel is the level of the messages logged by the channel
+	logLevel = channel.LevelError
 
 	rootCmd = &cobra.Command{
 		Use:           "cliptun",
@@ -26,6 +32,7 @@ var (
 			}
 			if debug {
 				debugLogger = log.New(os.Stderr, "DEBUG: ", 0)
+				logLevel = channel.LevelDebug
 			}
 
 			trace, err := cmd.Flags().GetBool("trace")
@@ -33,7 +40,7 @@ var (
 				errorLogger.Fatalln("cannot parse trace flag:", err)
 			}
 			if trace {
-				traceLogger = log.New(os.Stderr, "TRACE: ", 0)
+				logLevel = channel.LevelTrace
 			}
 		},
 	}
@@ -42,7 +49,33 @@ var (
 func init() {
 	rootCmd.PersistentFlags().DurationP("interval", "i", 1*time.Second, "interval to check for clipboard changes / interact with transport")
 	rootCmd.PersistentFlags().StringP("blocksize", "b", "64k", "max data sent per packet via transport")
-	rootCmd.PersistentFlags().StringP("password", "p", "cliptun", "password for encrypting the tunnel")
+	rootCmd.PersistentFlags().BoolP("auto-tune", "", false, "adjust interval and blocksize to the observed link quality")
+	rootCmd.PersistentFlags().DurationP("min-interval", "", 0, "lower bound for the interval when auto-tuning (default interval/4)")
+	rootCmd.PersistentFlags().DurationP("max-interval", "", 0, "upper bound for the interval when auto-tuning (default interval*4)")
+	rootCmd.PersistentFlags().StringP("min-blocksize", "", "", "lower bound for the blocksize when auto-tuning (default blocksize/16)")
+	rootCmd.PersistentFlags().StringP("max-blocksize", "", "", "upper bound for the blocksize when auto-tuning (default blocksize)")
+	rootCmd.PersistentFlags().BoolP("probe-blocksize", "", false, "probe for the largest blocksize getting through (between min-blocksize and max-blocksize)")
+	rootCmd.PersistentFlags().IntP("window", "w", 1, "number of packets sent without waiting for an acknowledgement (stream transports only)")
+	rootCmd.PersistentFlags().StringP("password", "p", "", "password for encrypting the tunnel (visible to other users, prefer the options below)")
+	rootCmd.PersistentFlags().StringP("password-env", "", "CLIPTUN_PASSWORD", "read the password from this environment variable")
+	rootCmd.PersistentFlags().StringP("password-file", "", "", "read the password from the first line of this file")
+	rootCmd.PersistentFlags().IntP("password-fd", "", 0, "read the password from this file descriptor")
+	rootCmd.PersistentFlags().BoolP("ask-password", "", false, "prompt for the password on the terminal")
+	rootCmd.PersistentFlags().BoolP("insecure-default-password", "", false, "allow using the built-in default password \"cliptun\"")
+	rootCmd.PersistentFlags().StringP("kdf", "", "pbkdf2", "key derivation function for the password (pbkdf2|argon2id|scrypt, optionally followed by :<param>=<value>,...)")
+	rootCmd.PersistentFlags().StringP("key-file", "", "", "read a 32 byte key (raw, hex or base64) from this file instead of using a password")
+	rootCmd.PersistentFlags().BoolP("pair", "", false, "authenticate the peer by comparing a pairing code instead of relying on the password")
+	rootCmd.PersistentFlags().Int64P("rekey-packets", "", 0, "switch to new keys after this many packets (0 to disable)")
+	rootCmd.PersistentFlags().StringP("rekey-bytes", "", "1g", "switch to new keys after this much data (0 to disable)")
+	rootCmd.PersistentFlags().DurationP("rekey-interval", "", 1*time.Hour, "switch to new keys after this time (0 to disable)")
+	rootCmd.PersistentFlags().StringP("compression", "", "zlib", "compression codec ("+strings.Join(channel.CodecNames(), "|")+"), packets that do not shrink are sent uncompressed")
+	rootCmd.PersistentFlags().BoolP("stream-compression", "", false, "compress data using a stream shared by all packets (useful for interactive sessions)")
+	rootCmd.PersistentFlags().StringP("encoding", "", "", "text encoding for packets ("+strings.Join(channel.EncodingNames(), "|")+"), defaults to the encoding chosen by the peer or base64")
+	rootCmd.PersistentFlags().IntP("wrap", "", 0, "wrap packets into lines of this many characters (0 to disable)")
+	rootCmd.PersistentFlags().Float64P("fec", "", 0, "send this ratio of parity packets to reconstruct lost packets without a resync (e.g. 0.2 for a parity packet per 5 packets, 0 to disable)")
+	rootCmd.PersistentFlags().DurationP("peer-timeout", "", 0, "exit if the peer does not respond for this time, also right after startup (0 to wait forever)")
+	rootCmd.PersistentFlags().DurationP("keepalive", "", 0, "send keepalive packets after this time without traffic (default peer-timeout/3)")
+	rootCmd.PersistentFlags().StringP("session-file", "", "", "save the session to this file to resume it after a restart or Ctrl-C (contains the session keys, sealed using the password: recorded traffic can be decrypted once the password becomes known)")
 	rootCmd.PersistentFlags().StringP("transport", "t", "clipboard", "transport for tunnel (clipboard|exec=<cmd>|tcp-listen=<addr>:<port>|tcp=<addr>:<port>)")
 	rootCmd.PersistentFlags().BoolP("debug", "d", false, "enable debug output")
 	rootCmd.PersistentFlags().BoolP("trace", "", false, "trace packets read/written to transport")
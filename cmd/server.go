@@ -18,12 +18,17 @@ var serverCmd = &cobra.Command{
 		if err != nil {
 			errorLogger.Fatalln("Cannot create channel:", err)
 		}
+		reportConnection(tunnel.Channel)
+		handleInterrupt(tunnel.Channel)
 
-		tunnel.StartServer()
+		if err := tunnel.StartServer(); err != nil {
+			errorLogger.Fatalln(err)
+		}
 
 	},
 }
 
 func init() {
+	addNameFlag(serverCmd)
 	rootCmd.AddCommand(serverCmd)
 }
@@ -21,24 +21,53 @@ var stdinCmd = &cobra.Command{
 		if err != nil {
 			errorLogger.Fatalln("cannot create channel:", err)
 		}
+		reportStats(cmd, channel)
+		handleInterrupt(channel)
+		if broadcast, _ := cmd.Flags().GetBool("broadcast"); broadcast {
+			broadcastStdin(channel)
+		}
+		reportConnection(channel)
 
 		var sendFIN sync.Once
 		for {
-			data := make([]byte, options.Blocksize)
+			data := make([]byte, channel.Blocksize())
 			length, err := os.Stdin.Read(data)
 			// if err == io.EOF {
 			if err != nil {
 				sendFIN.Do(func() {
-					channel.CloseChannel()
+					go channel.Close()
 				})
 			} else {
 				channel.Send(data[0:length])
 			}
-			channel.Receive()
+			if _, err := channel.Receive(); err != nil {
+				break
+			}
 		}
+		exitOnClose(channel)
 	},
 }
 
+// broadcastStdin sends all data read from STDIN in broadcast mode, where
+// nothing is received from the peer, and exits once it has been sent.
+func broadcastStdin(c *channel.Channel) {
+	for {
+		data := make([]byte, c.Blocksize())
+		length, err := os.Stdin.Read(data)
+		if length > 0 {
+			c.Send(data[0:length])
+		}
+		if err != nil {
+			break
+		}
+	}
+	go c.Close()
+	exitOnClose(c)
+}
+
 func init() {
+	addStatsIntervalFlag(stdinCmd)
+	addBroadcastFlags(stdinCmd)
+	addPeerFlag(stdinCmd)
 	rootCmd.AddCommand(stdinCmd)
 }
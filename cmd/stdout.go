@@ -20,16 +20,31 @@ var stdoutCmd = &cobra.Command{
 		if err != nil {
 			errorLogger.Fatalln("Cannot create channel:", err)
 		}
+		broadcast, _ := cmd.Flags().GetBool("broadcast")
+		reportConnection(channel)
+		reportStats(cmd, channel)
+		handleInterrupt(channel)
 
 		for {
-			cbdata := channel.Receive()
+			cbdata, err := channel.Receive()
+			if err != nil {
+				break
+			}
 			os.Stdout.Write(cbdata)
+			if broadcast {
+				// the peer does not wait for acknowledgements
+				continue
+			}
 			data := []byte("")
 			channel.Send(data)
 		}
+		exitOnClose(channel)
 	},
 }
 
 func init() {
+	addStatsIntervalFlag(stdoutCmd)
+	addBroadcastFlags(stdoutCmd)
+	addNameFlag(stdoutCmd)
 	rootCmd.AddCommand(stdoutCmd)
 }
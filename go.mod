@@ -3,11 +3,14 @@ module github.com/svent/cliptun
 go 1.13
 
 require (
+	github.com/andybalholm/brotli v1.0.2
 	github.com/armon/go-socks5 v0.0.0-20160902184237-e75332964ef5
 	github.com/atotto/clipboard v0.1.2
 	github.com/dustin/go-humanize v1.0.0
+	github.com/klauspost/compress v1.12.3
 	github.com/mattn/go-shellwords v1.0.6
 	github.com/peterh/liner v1.1.0
+	github.com/pierrec/lz4/v3 v3.3.4
 	github.com/pkg/sftp v1.10.1
 	github.com/spf13/cobra v0.0.5
 	github.com/svent/go-nbreader v0.0.0-20150201200112-7cef48da76dc
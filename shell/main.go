@@ -8,6 +8,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/peterh/liner"
@@ -103,6 +104,26 @@ func Execute(tunnel *channel.Tunnel) {
 			return nil
 		},
 	}
+	cmds["stats"] = prompt.Cmd{
+		Name:        "stats",
+		Description: "show statistics of the link",
+		Usage:       "stats",
+		Run: func(cmd prompt.Cmd, args []string) error {
+			s := tunnel.Stats()
+			fmt.Printf("packets sent:        %d (%s)\n", s.PacketsSent, humanize.IBytes(uint64(s.BytesSent)))
+			fmt.Printf("packets received:    %d (%s)\n", s.PacketsReceived, humanize.IBytes(uint64(s.BytesReceived)))
+			fmt.Printf("data sent:           %s\n", humanize.IBytes(uint64(s.DataSent)))
+			fmt.Printf("data received:       %s\n", humanize.IBytes(uint64(s.DataReceived)))
+			fmt.Printf("retransmissions:     %d\n", s.Retransmissions)
+			fmt.Printf("resyncs:             %d\n", s.Resyncs)
+			fmt.Printf("recovered (fec):     %d\n", s.Recovered)
+			fmt.Printf("decryption failures: %d\n", s.DecryptionFailures)
+			fmt.Printf("round trip time:     %s\n", s.RTT.Round(time.Millisecond))
+			fmt.Printf("throughput:          %s/s\n", humanize.IBytes(uint64(s.Throughput)))
+			fmt.Printf("queued packets:      %d\n", s.QueueDepth)
+			return nil
+		},
+	}
 	cmds["socks"] = prompt.Cmd{
 		Name:        "socks",
 		Description: "Start SOCKS server",
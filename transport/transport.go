@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"net"
@@ -19,6 +20,15 @@ type Transport interface {
 	Reset()
 }
 
+// Every packet is enclosed in PacketBegin and PacketEnd, so packets can be
+// found in clipboard content mangled by line wrapping or added whitespace,
+// and separated on stream transports, which (unlike the clipboard) keep
+// every packet written. Whitespace between packets is ignored.
+const (
+	PacketBegin = "~CT{"
+	PacketEnd   = "}~"
+)
+
 type Clipboard struct{}
 
 func (c *Clipboard) Read() (string, error) {
@@ -34,11 +44,36 @@ func (c *Clipboard) Reset() {
 	clipboard.WriteAll(strconv.FormatInt(time.Now().UnixNano(), 10))
 }
 
+// packetReader buffers data read from a stream until complete packets
+// are available, as a single read may end in the middle of a packet.
+type packetReader struct {
+	reader  io.Reader
+	buf     []byte
+	pending []byte
+}
+
+func newPacketReader(r io.Reader, bufferSize int) *packetReader {
+	return &packetReader{reader: r, buf: make([]byte, bufferSize*2)}
+}
+
+// Read returns all complete packets received so far.
+func (p *packetReader) Read() (string, error) {
+	n, err := p.reader.Read(p.buf)
+	p.pending = append(p.pending, p.buf[:n]...)
+	i := bytes.LastIndex(p.pending, []byte(PacketEnd))
+	if i < 0 {
+		return "", err
+	}
+	i += len(PacketEnd)
+	s := string(p.pending[:i])
+	p.pending = append(p.pending[:0], p.pending[i:]...)
+	return s, err
+}
+
 type Command struct {
-	cmd        *exec.Cmd
-	stdin      io.Writer
-	stdout     io.Reader
-	bufferSize int
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *packetReader
 }
 
 func NewCommand(cmd string, bufferSize int, interval time.Duration) (*Command, error) {
@@ -53,7 +88,6 @@ func NewCommand(cmd string, bufferSize int, interval time.Duration) (*Command, e
 	} else {
 		c = &Command{cmd: exec.Command(cmd)}
 	}
-	c.bufferSize = bufferSize
 	c.stdin, err = c.cmd.StdinPipe()
 	if err != nil {
 		return nil, fmt.Errorf("cannot open stdin for transport command: %s", err)
@@ -62,7 +96,7 @@ func NewCommand(cmd string, bufferSize int, interval time.Duration) (*Command, e
 	if err != nil {
 		return nil, fmt.Errorf("cannot open stdout for transport command: %s", err)
 	}
-	c.stdout = nbreader.NewNBReader(stdout, bufferSize, nbreader.ChunkTimeout(interval/2), nbreader.Timeout(interval*4/5))
+	c.stdout = newPacketReader(nbreader.NewNBReader(stdout, bufferSize, nbreader.ChunkTimeout(interval/2), nbreader.Timeout(interval*4/5)), bufferSize)
 	err = c.cmd.Start()
 	if err != nil {
 		return nil, fmt.Errorf("cannot execute transport command: %s", err)
@@ -71,23 +105,27 @@ func NewCommand(cmd string, bufferSize int, interval time.Duration) (*Command, e
 }
 
 func (c *Command) Read() (string, error) {
-	b := make([]byte, c.bufferSize*2)
-	n, err := c.stdout.Read(b)
-	return string(b[:n]), err
+	return c.stdout.Read()
 }
 
 func (c *Command) Write(text string) error {
-	_, err := c.stdin.Write([]byte(text))
+	_, err := c.stdin.Write([]byte(text + "\n"))
 	return err
 }
 
 func (c *Command) Reset() {
 }
 
+// Close terminates the transport command.
+func (c *Command) Close() error {
+	c.stdin.Close()
+	c.cmd.Process.Kill()
+	return c.cmd.Wait()
+}
+
 type TCPConn struct {
-	conn       net.Conn
-	reader     io.Reader
-	bufferSize int
+	conn   net.Conn
+	reader *packetReader
 }
 
 func DialTCP(addr string, bufferSize int, interval time.Duration) (*TCPConn, error) {
@@ -96,7 +134,7 @@ func DialTCP(addr string, bufferSize int, interval time.Duration) (*TCPConn, err
 		return nil, fmt.Errorf("cannot dial connection: %s", err)
 	}
 	stdout := nbreader.NewNBReader(c, bufferSize, nbreader.ChunkTimeout(interval/2), nbreader.Timeout(interval*4/5))
-	return &TCPConn{c, stdout, bufferSize}, nil
+	return &TCPConn{c, newPacketReader(stdout, bufferSize)}, nil
 }
 
 func ListenTCP(addr string, bufferSize int, interval time.Duration) (*TCPConn, error) {
@@ -104,24 +142,27 @@ func ListenTCP(addr string, bufferSize int, interval time.Duration) (*TCPConn, e
 	if err != nil {
 		return nil, fmt.Errorf("cannot start listener: %s", err)
 	}
+	defer l.Close()
 	c, err := l.Accept()
 	if err != nil {
 		return nil, fmt.Errorf("cannot accept tcp connection: %s", err)
 	}
 	r := nbreader.NewNBReader(c, bufferSize, nbreader.ChunkTimeout(interval/2), nbreader.Timeout(interval*4/5))
-	return &TCPConn{c, r, bufferSize}, nil
+	return &TCPConn{c, newPacketReader(r, bufferSize)}, nil
 }
 
 func (c *TCPConn) Read() (string, error) {
-	b := make([]byte, c.bufferSize*2)
-	n, err := c.reader.Read(b)
-	return string(b[:n]), err
+	return c.reader.Read()
 }
 
 func (c *TCPConn) Write(text string) error {
-	_, err := c.conn.Write([]byte(text))
+	_, err := c.conn.Write([]byte(text + "\n"))
 	return err
 }
 
 func (c *TCPConn) Reset() {
 }
+
+func (c *TCPConn) Close() error {
+	return c.conn.Close()
+}